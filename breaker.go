@@ -0,0 +1,222 @@
+package seo4ajax
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+)
+
+// ErrCircuitOpen is returned by Fetch while the circuit breaker is open
+var ErrCircuitOpen = errors.New("seo4ajax circuit breaker open")
+
+// BreakerState is the state of the circuit breaker
+type BreakerState int
+
+// Circuit breaker states, reported as value of Metrics.BreakerState
+const (
+	// BreakerClosed lets all fetches pass
+	BreakerClosed BreakerState = iota
+	// BreakerHalfOpen lets a limited number of trial fetches pass
+	BreakerHalfOpen
+	// BreakerOpen fails all fetches immediately
+	BreakerOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	}
+	return "unknown"
+}
+
+// BreakerConfig configures the circuit breaker around seo4ajax. It opens if the ratio of failed
+// fetches within Window exceeds FailureRatio, fails fetches for OpenTimeout and then lets
+// HalfOpenRequests trial fetches pass which close it again on success.
+type BreakerConfig struct {
+	// Window is the sliding window failures are counted in, the breaker is disabled if zero
+	Window time.Duration
+	// MinRequests is the number of fetches within Window required to open, defaults to 20
+	MinRequests int
+	// FailureRatio is the ratio of failed fetches which opens the breaker, defaults to 0.5
+	FailureRatio float64
+	// OpenTimeout is the time the breaker stays open before trial fetches are made, defaults to 30s
+	OpenTimeout time.Duration
+	// HalfOpenRequests is the number of concurrent trial fetches, defaults to 1
+	HalfOpenRequests int
+}
+
+const breakerBuckets = 10
+
+type breaker struct {
+	log   log.Logger
+	gauge metrics.Gauge
+
+	minRequests      int
+	failureRatio     float64
+	openTimeout      time.Duration
+	halfOpenRequests int
+	bucketSize       time.Duration
+
+	mu       sync.Mutex
+	state    BreakerState
+	openedAt time.Time
+	trials   int
+	buckets  [breakerBuckets]breakerBucket
+}
+
+type breakerBucket struct {
+	start            time.Time
+	success, failure int
+}
+
+func newBreaker(cfg BreakerConfig, logger log.Logger, gauge metrics.Gauge) *breaker {
+	if cfg.Window <= 0 {
+		return nil
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = 20
+	}
+	if cfg.FailureRatio <= 0 {
+		cfg.FailureRatio = 0.5
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = 30 * time.Second
+	}
+	if cfg.HalfOpenRequests <= 0 {
+		cfg.HalfOpenRequests = 1
+	}
+	bucketSize := cfg.Window / breakerBuckets
+	if bucketSize <= 0 {
+		bucketSize = 1
+	}
+	gauge.Set(float64(BreakerClosed))
+	return &breaker{
+		log:              logger,
+		gauge:            gauge,
+		minRequests:      cfg.MinRequests,
+		failureRatio:     cfg.FailureRatio,
+		openTimeout:      cfg.OpenTimeout,
+		halfOpenRequests: cfg.HalfOpenRequests,
+		bucketSize:       bucketSize,
+	}
+}
+
+// allow reports whether a fetch may pass and whether it is a trial fetch of the half-open state
+func (b *breaker) allow() (trial, ok bool) {
+	if b == nil {
+		return false, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerClosed:
+		return false, true
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.openTimeout {
+			return false, false
+		}
+		b.transition(BreakerHalfOpen)
+	}
+	if b.trials >= b.halfOpenRequests {
+		return false, false
+	}
+	b.trials++
+	return true, true
+}
+
+// done records the result of a fetch allowed before. Cancelled and rejected fetches don't count
+func (b *breaker) done(trial bool, err error) {
+	if b == nil {
+		return
+	}
+	neutral := err == context.Canceled || err == context.DeadlineExceeded || err == ErrOverloaded
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if trial {
+		if b.state != BreakerHalfOpen {
+			return
+		}
+		b.trials--
+		switch {
+		case neutral:
+		case err == nil:
+			b.transition(BreakerClosed)
+		default:
+			b.transition(BreakerOpen)
+		}
+		return
+	}
+
+	if b.state != BreakerClosed || neutral {
+		return
+	}
+	now := time.Now()
+	bucket := b.bucket(now)
+	if err == nil {
+		bucket.success++
+		return
+	}
+	bucket.failure++
+
+	var success, failure int
+	for _, bk := range b.buckets {
+		if now.Sub(bk.start) < b.bucketSize*breakerBuckets {
+			success += bk.success
+			failure += bk.failure
+		}
+	}
+	total := success + failure
+	if total >= b.minRequests && float64(failure)/float64(total) >= b.failureRatio {
+		b.transition(BreakerOpen)
+	}
+}
+
+// bucket returns the bucket of the given time, resetting it if it is outdated
+func (b *breaker) bucket(now time.Time) *breakerBucket {
+	start := now.Truncate(b.bucketSize)
+	bucket := &b.buckets[(start.UnixNano()/int64(b.bucketSize))%breakerBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = breakerBucket{start: start}
+	}
+	return bucket
+}
+
+func (b *breaker) transition(state BreakerState) {
+	b.log.Log("level", "warn", "msg", "Circuit breaker state changed", "from", b.state, "to", state)
+	b.state = state
+	b.trials = 0
+	switch state {
+	case BreakerOpen:
+		b.openedAt = time.Now()
+	case BreakerClosed:
+		b.buckets = [breakerBuckets]breakerBucket{}
+	}
+	b.gauge.Set(float64(state))
+}
+
+func (b *breaker) current() BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+// BreakerState returns the current state of the circuit breaker, always BreakerClosed if it is disabled
+func (c *Client) BreakerState() BreakerState {
+	return c.breaker.current()
+}
@@ -0,0 +1,131 @@
+package seo4ajax
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	Convey("the circuit breaker", t, func() {
+		var (
+			status int32 = http.StatusInternalServerError
+			hits   int32
+		)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+		}))
+		defer ts.Close()
+
+		state := &testGauge{}
+		seo4ajaxClient, err := New(Config{
+			Token:   "123",
+			Server:  ts.URL,
+			Timeout: 10 * time.Millisecond,
+			Metrics: Metrics{BreakerState: state},
+			Breaker: BreakerConfig{
+				Window:      time.Minute,
+				MinRequests: 2,
+				OpenTimeout: 100 * time.Millisecond,
+			},
+		})
+		So(err, ShouldBeNil)
+		So(seo4ajaxClient.BreakerState(), ShouldEqual, BreakerClosed)
+
+		fetch := func() error {
+			page, err := seo4ajaxClient.Fetch(context.Background(), &url.URL{Path: "/page"}, nil)
+			if err == nil {
+				page.Body.Close()
+			}
+			return err
+		}
+
+		Convey("opens after too many failures and fails fast", func() {
+			var upstreamErr *UpstreamError
+			So(errors.As(fetch(), &upstreamErr), ShouldBeTrue)
+			So(seo4ajaxClient.BreakerState(), ShouldEqual, BreakerClosed)
+			So(errors.As(fetch(), &upstreamErr), ShouldBeTrue)
+			So(seo4ajaxClient.BreakerState(), ShouldEqual, BreakerOpen)
+			So(state.get(), ShouldEqual, float64(BreakerOpen))
+
+			before := atomic.LoadInt32(&hits)
+			So(fetch(), ShouldEqual, ErrCircuitOpen)
+			So(atomic.LoadInt32(&hits), ShouldEqual, before)
+
+			Convey("and closes after a successful trial fetch", func() {
+				atomic.StoreInt32(&status, http.StatusOK)
+				time.Sleep(100 * time.Millisecond)
+				So(fetch(), ShouldBeNil)
+				So(seo4ajaxClient.BreakerState(), ShouldEqual, BreakerClosed)
+				So(state.get(), ShouldEqual, float64(BreakerClosed))
+			})
+
+			Convey("and opens again after a failed trial fetch", func() {
+				time.Sleep(100 * time.Millisecond)
+				So(errors.As(fetch(), &upstreamErr), ShouldBeTrue)
+				So(seo4ajaxClient.BreakerState(), ShouldEqual, BreakerOpen)
+				So(fetch(), ShouldEqual, ErrCircuitOpen)
+			})
+
+			Convey("and makes crawlers fall back to the error status", func() {
+				req, err := http.NewRequest("GET", "http://"+appAdress+"/page?_escaped_fragment_=", nil)
+				So(err, ShouldBeNil)
+				recorder := httptest.NewRecorder()
+				seo4ajaxClient.ServeHTTP(recorder, req)
+				So(recorder.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(atomic.LoadInt32(&hits), ShouldEqual, before)
+			})
+		})
+
+		Convey("works with tiny windows", func() {
+			b := newBreaker(BreakerConfig{Window: time.Nanosecond, MinRequests: 1}, seo4ajaxClient.log, state)
+			So(func() { b.done(false, ErrUnknownStatus) }, ShouldNotPanic)
+			So(b.current(), ShouldEqual, BreakerOpen)
+		})
+
+		Convey("ignores cancelled fetches", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			for i := 0; i < 3; i++ {
+				seo4ajaxClient.Fetch(ctx, &url.URL{Path: "/page"}, nil)
+			}
+			So(seo4ajaxClient.BreakerState(), ShouldEqual, BreakerClosed)
+		})
+	})
+}
+
+// testGauge is a metrics.Gauge recording the last value set
+type testGauge struct {
+	mu    sync.Mutex
+	value float64
+}
+
+func (g *testGauge) With(labelValues ...string) metrics.Gauge { return g }
+
+func (g *testGauge) Set(value float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.value = value
+}
+
+func (g *testGauge) Add(delta float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.value += delta
+}
+
+func (g *testGauge) get() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.value
+}
@@ -0,0 +1,81 @@
+package seo4ajax
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBufferResponses(t *testing.T) {
+	Convey("snapshots", t, func() {
+		var (
+			hits      int32
+			truncated int32 = 1
+		)
+		snapshot := strings.Repeat("snapshot ", 100)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			if atomic.AddInt32(&truncated, -1) >= 0 {
+				// the connection is closed after the announced length wasn't written
+				w.Header().Set("Content-Length", "10000")
+			}
+			w.Write([]byte(snapshot))
+		}))
+		defer ts.Close()
+
+		cfg := Config{
+			Token:   "123",
+			Server:  ts.URL,
+			Timeout: time.Second,
+			Retry:   RetryPolicy{InitialInterval: time.Millisecond},
+		}
+		get := func() *httptest.ResponseRecorder {
+			seo4ajaxClient, err := New(cfg)
+			So(err, ShouldBeNil)
+			req, err := http.NewRequest("GET", "http://"+appAdress+"/page?_escaped_fragment_=", nil)
+			So(err, ShouldBeNil)
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		Convey("are truncated if streamed", func() {
+			recorder := get()
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(recorder.Body.Len(), ShouldBeLessThan, 10000)
+			So(atomic.LoadInt32(&hits), ShouldEqual, 1)
+		})
+
+		Convey("are complete if buffered", func() {
+			cfg.BufferResponses = true
+			recorder := get()
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(recorder.Body.String(), ShouldEqual, snapshot)
+			So(recorder.Header().Get("Content-Length"), ShouldEqual, "900")
+			So(atomic.LoadInt32(&hits), ShouldEqual, 2)
+		})
+
+		Convey("fail if buffering doesn't succeed", func() {
+			cfg.BufferResponses = true
+			cfg.Retry.MaxAttempts = 1
+			recorder := get()
+			So(recorder.Code, ShouldEqual, http.StatusServiceUnavailable)
+			So(recorder.Body.String(), ShouldNotContainSubstring, "snapshot")
+		})
+
+		Convey("are streamed if larger than MaxBufferSize", func() {
+			atomic.StoreInt32(&truncated, 0)
+			cfg.BufferResponses = true
+			cfg.MaxBufferSize = 100
+			recorder := get()
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(recorder.Body.String(), ShouldEqual, snapshot)
+			So(atomic.LoadInt32(&hits), ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,259 @@
+package seo4ajax
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache status values reported in the CacheStatusHeader
+const (
+	CacheHit  = "HIT"
+	CacheMiss = "MISS"
+)
+
+// Cache stores snapshots. Implementations must be safe for concurrent use
+type Cache interface {
+	// Get returns the entry stored for key, it may be expired
+	Get(key string) (*CacheEntry, bool)
+	// Set stores the entry for key, entries must not be modified afterwards
+	Set(key string, entry *CacheEntry)
+	// Delete removes the entry stored for key
+	Delete(key string)
+}
+
+// CacheEntry is a cached snapshot
+type CacheEntry struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	StoredAt   time.Time
+	Expires    time.Time
+	// ETag is the strong entity tag served to clients, derived from the Body. The validators of
+	// seo4ajax are kept in Header
+	ETag string
+}
+
+// Fresh reports whether the entry is not yet expired at the given time
+func (e *CacheEntry) Fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+func (e *CacheEntry) size() int64 {
+	return int64(len(e.Body))
+}
+
+// MemoryCache is an in-process LRU snapshot cache bounded by entry count and total body size
+type MemoryCache struct {
+	maxEntries int
+	maxBytes   int64
+
+	mu      sync.Mutex
+	bytes   int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type memoryCacheItem struct {
+	key   string
+	entry *CacheEntry
+}
+
+// NewMemoryCache creates a new MemoryCache. A limit of zero means no limit
+func NewMemoryCache(maxEntries int, maxBytes int64) *MemoryCache {
+	return &MemoryCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+// Get returns the entry stored for key, it may be expired
+func (c *MemoryCache) Get(key string) (*CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*memoryCacheItem).entry, true
+}
+
+// Set stores the entry for key, evicting the least recently used entries if a limit is exceeded.
+// Entries larger than the byte limit are not stored
+func (c *MemoryCache) Set(key string, entry *CacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(key)
+	if c.maxBytes > 0 && entry.size() > c.maxBytes {
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&memoryCacheItem{key: key, entry: entry})
+	c.bytes += entry.size()
+
+	for (c.maxEntries > 0 && c.lru.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.remove(c.lru.Back().Value.(*memoryCacheItem).key)
+	}
+}
+
+// Delete removes the entry stored for key
+func (c *MemoryCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(key)
+}
+
+// Len returns the number of cached entries
+func (c *MemoryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+func (c *MemoryCache) remove(key string) {
+	el, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.lru.Remove(el)
+	delete(c.entries, key)
+	c.bytes -= el.Value.(*memoryCacheItem).entry.size()
+}
+
+// cacheKey returns the cache key of the request, the cleaned path plus the values of the
+// variant headers
+func (c *Client) cacheKey(r *http.Request) string {
+	key := cleanPath(r.URL)
+	for _, h := range c.cacheVary {
+		key += "\n" + h + ":" + strings.Join(r.Header[h], ",")
+	}
+	return key
+}
+
+// cacheTTL derives the time to live of a snapshot from its Cache-Control and Expires headers.
+// It returns false if the snapshot must not be cached
+func cacheTTL(h http.Header, now time.Time, defaultTTL time.Duration) (time.Duration, bool) {
+	var maxAge, sMaxAge = -1, -1
+	for _, v := range h["Cache-Control"] {
+		for _, directive := range strings.Split(v, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			name, value := directive, ""
+			if i := strings.IndexByte(directive, '='); i >= 0 {
+				name, value = directive[:i], strings.Trim(directive[i+1:], `"`)
+			}
+			switch name {
+			case "no-store", "no-cache", "private":
+				return 0, false
+			case "max-age":
+				if n, err := strconv.Atoi(value); err == nil {
+					maxAge = n
+				}
+			case "s-maxage":
+				if n, err := strconv.Atoi(value); err == nil {
+					sMaxAge = n
+				}
+			}
+		}
+	}
+
+	var ttl time.Duration
+	switch {
+	case sMaxAge >= 0:
+		ttl = time.Duration(sMaxAge) * time.Second
+	case maxAge >= 0:
+		ttl = time.Duration(maxAge) * time.Second
+	case h.Get("Expires") != "":
+		expires, err := http.ParseTime(h.Get("Expires"))
+		if err != nil {
+			return 0, false
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		ttl = expires.Sub(date)
+	default:
+		ttl = defaultTTL
+	}
+	return ttl, ttl > 0
+}
+
+// storePage caches the page if it is cacheable. The page body is replaced by an in-memory copy.
+// Any cached snapshot is dropped if the page is not a cacheable snapshot or content-encoded
+func (c *Client) storePage(key string, page *Page) {
+	if page.StatusCode != http.StatusOK || encoded(page.Header) {
+		c.cache.Delete(key)
+		return
+	}
+	now := time.Now()
+	ttl, ok := cacheTTL(page.Header, now, c.cacheTTL)
+	if !ok {
+		// the cached snapshot is outdated, it must not be served stale either
+		c.cache.Delete(key)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(page.Body, c.cacheMaxEntrySize+1))
+	if err != nil || int64(len(body)) > c.cacheMaxEntrySize {
+		// too large or broken, stream what we have read along with the rest
+		page.Body = readCloser{io.MultiReader(bytes.NewReader(body), page.Body), page.Body}
+		return
+	}
+	page.Body.Close()
+	page.Body = ioutil.NopCloser(bytes.NewReader(body))
+	page.ContentLength = int64(len(body))
+
+	entry := &CacheEntry{
+		StatusCode: page.StatusCode,
+		Header:     page.Header,
+		Body:       body,
+		StoredAt:   now,
+		Expires:    now.Add(ttl),
+		ETag:       snapshotETag(body),
+	}
+	c.cache.Set(key, entry)
+	page.etag = entry.ETag
+	page.lastModified = entry.lastModified()
+}
+
+// encoded reports whether the body is still content-encoded, e.g. compressed by a Transport
+// which doesn't decode it
+func encoded(h http.Header) bool {
+	encoding := h.Get("Content-Encoding")
+	return encoding != "" && !strings.EqualFold(encoding, "identity")
+}
+
+// cachedPage returns a Page serving the cached entry
+func cachedPage(entry *CacheEntry) *Page {
+	return &Page{
+		StatusCode:    entry.StatusCode,
+		Header:        entry.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(entry.Body)),
+		ContentLength: int64(len(entry.Body)),
+		etag:          entry.ETag,
+		lastModified:  entry.lastModified(),
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
@@ -0,0 +1,340 @@
+package seo4ajax
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// fileCacheVersion is the version of the metadata format, entries of other versions are removed.
+// Version 1 stores the generated ETag instead of the one of seo4ajax, version 2 adds the checksum
+// of the body
+const fileCacheVersion = 2
+
+const (
+	fileCacheMetaExt = ".json"
+	fileCacheBodyExt = ".body"
+	fileCacheTempExt = ".tmp"
+)
+
+// FileCacheConfig is the FileCache config
+type FileCacheConfig struct {
+	Log      log.Logger
+	Dir      string // directory the snapshots are stored in, must be set
+	MaxBytes int64  // maximum total size of the stored bodies, no limit if zero
+}
+
+// FileCache is a disk-backed snapshot cache. Each entry is stored as a body file and a JSON
+// metadata file, both written atomically. Existing entries are picked up on startup and the
+// least recently used entries are evicted if MaxBytes is exceeded.
+type FileCache struct {
+	log      log.Logger
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	bytes   int64
+	lru     *list.List
+	entries map[string]*list.Element // by file name hash
+}
+
+type fileCacheItem struct {
+	hash string
+	size int64
+}
+
+// fileCacheMeta is the JSON metadata stored next to each body
+type fileCacheMeta struct {
+	Version    int         `json:"version"`
+	Key        string      `json:"key"`
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	StoredAt   time.Time   `json:"stored_at"`
+	Expires    time.Time   `json:"expires"`
+	ETag       string      `json:"etag,omitempty"`
+	Size       int64       `json:"size"`
+	Sum        string      `json:"sum"` // sha256 of the body
+}
+
+// NewFileCache creates a new FileCache, creating the directory if needed and scanning it for
+// existing entries. Incomplete entries left behind by a crash and entries of former versions are
+// removed
+func NewFileCache(cfg FileCacheConfig) (*FileCache, error) {
+	if cfg.Log == nil {
+		cfg.Log = log.NewNopLogger()
+	}
+	if cfg.Dir == "" {
+		return nil, errors.New("no file cache directory given")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	c := &FileCache{
+		log:      cfg.Log,
+		dir:      cfg.Dir,
+		maxBytes: cfg.MaxBytes,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+	}
+	if err := c.scan(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Get implements Cache
+func (c *FileCache) Get(key string) (*CacheEntry, bool) {
+	hash := fileCacheHash(key)
+
+	c.mu.Lock()
+	el, ok := c.entries[hash]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	// the files are read without holding the lock, a concurrent Set of the same key may replace
+	// them in between, which the checksum detects
+	meta, err := c.readMeta(hash)
+	if err != nil || meta.Key != key {
+		return nil, false
+	}
+	body, err := ioutil.ReadFile(c.path(hash, fileCacheBodyExt))
+	if err == nil && (int64(len(body)) != meta.Size || fileCacheSum(body) != meta.Sum) {
+		err = errors.New("checksum mismatch")
+	}
+	if err != nil {
+		c.mu.Lock()
+		replaced := c.entries[hash] != el
+		if !replaced {
+			c.unindex(hash)
+		}
+		c.mu.Unlock()
+		if !replaced {
+			c.log.Log("level", "warn", "msg", "Reading cached snapshot failed", "err", err, "key", key)
+			c.removeFiles(hash)
+		}
+		return nil, false
+	}
+
+	return &CacheEntry{
+		StatusCode: meta.StatusCode,
+		Header:     meta.Header,
+		Body:       body,
+		StoredAt:   meta.StoredAt,
+		Expires:    meta.Expires,
+		ETag:       meta.ETag,
+	}, true
+}
+
+// Set implements Cache
+func (c *FileCache) Set(key string, entry *CacheEntry) {
+	hash := fileCacheHash(key)
+	size := int64(len(entry.Body))
+
+	if c.maxBytes > 0 && size > c.maxBytes {
+		c.Delete(key)
+		return
+	}
+
+	meta, err := json.Marshal(fileCacheMeta{
+		Version:    fileCacheVersion,
+		Key:        key,
+		StatusCode: entry.StatusCode,
+		Header:     entry.Header,
+		StoredAt:   entry.StoredAt,
+		Expires:    entry.Expires,
+		ETag:       entry.ETag,
+		Size:       size,
+		Sum:        fileCacheSum(entry.Body),
+	})
+	// the files are written without holding the lock, concurrent writes of the same key are
+	// atomic renames and the last one wins
+	if err == nil {
+		// the metadata is written last, so an entry is only visible once its body is complete
+		err = c.writeFile(c.path(hash, fileCacheBodyExt), entry.Body)
+	}
+	if err == nil {
+		err = c.writeFile(c.path(hash, fileCacheMetaExt), meta)
+	}
+	if err != nil {
+		c.log.Log("level", "warn", "msg", "Writing cached snapshot failed", "err", err, "key", key)
+		c.Delete(key)
+		return
+	}
+
+	c.mu.Lock()
+	c.unindex(hash)
+	c.add(hash, size)
+	evicted := c.evict()
+	c.mu.Unlock()
+
+	for _, hash := range evicted {
+		c.removeFiles(hash)
+	}
+}
+
+// Delete implements Cache
+func (c *FileCache) Delete(key string) {
+	hash := fileCacheHash(key)
+
+	c.mu.Lock()
+	c.unindex(hash)
+	c.mu.Unlock()
+
+	c.removeFiles(hash)
+}
+
+// Len returns the number of cached entries
+func (c *FileCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+// scan indexes the entries found in the directory, the most recently written first
+func (c *FileCache) scan() error {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	var found []os.FileInfo
+	bodies := map[string]bool{}
+	for _, f := range files {
+		switch name := f.Name(); {
+		case strings.HasSuffix(name, fileCacheTempExt):
+			os.Remove(filepath.Join(c.dir, name))
+		case strings.HasSuffix(name, fileCacheBodyExt):
+			bodies[strings.TrimSuffix(name, fileCacheBodyExt)] = true
+		case strings.HasSuffix(name, fileCacheMetaExt):
+			found = append(found, f)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].ModTime().After(found[j].ModTime())
+	})
+
+	for _, f := range found {
+		hash := strings.TrimSuffix(f.Name(), fileCacheMetaExt)
+		meta, err := c.readMeta(hash)
+		if err == nil && meta.Version != fileCacheVersion {
+			err = fmt.Errorf("outdated version %d", meta.Version)
+		}
+		if err != nil || !bodies[hash] || fileCacheHash(meta.Key) != hash {
+			c.log.Log("level", "warn", "msg", "Removing broken cached snapshot", "err", err, "file", f.Name())
+			os.Remove(c.path(hash, fileCacheMetaExt))
+			continue
+		}
+		delete(bodies, hash)
+		el := c.lru.PushBack(&fileCacheItem{hash: hash, size: meta.Size})
+		c.entries[hash] = el
+		c.bytes += meta.Size
+	}
+	// bodies without metadata are leftovers of interrupted writes
+	for hash := range bodies {
+		os.Remove(c.path(hash, fileCacheBodyExt))
+	}
+
+	for _, hash := range c.evict() {
+		c.removeFiles(hash)
+	}
+	return nil
+}
+
+func (c *FileCache) readMeta(hash string) (*fileCacheMeta, error) {
+	data, err := ioutil.ReadFile(c.path(hash, fileCacheMetaExt))
+	if err != nil {
+		return nil, err
+	}
+	var meta fileCacheMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// writeFile writes the data to a temporary file which is renamed to path afterwards
+func (c *FileCache) writeFile(path string, data []byte) error {
+	f, err := ioutil.TempFile(c.dir, filepath.Base(path)+".*"+fileCacheTempExt)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (c *FileCache) add(hash string, size int64) {
+	c.entries[hash] = c.lru.PushFront(&fileCacheItem{hash: hash, size: size})
+	c.bytes += size
+}
+
+// evict removes the least recently used entries exceeding maxBytes from the index and returns
+// their hashes, the files are left to the caller
+func (c *FileCache) evict() []string {
+	var evicted []string
+	for c.maxBytes > 0 && c.bytes > c.maxBytes {
+		hash := c.lru.Back().Value.(*fileCacheItem).hash
+		c.unindex(hash)
+		evicted = append(evicted, hash)
+	}
+	return evicted
+}
+
+func (c *FileCache) unindex(hash string) {
+	el, ok := c.entries[hash]
+	if !ok {
+		return
+	}
+	c.lru.Remove(el)
+	delete(c.entries, hash)
+	c.bytes -= el.Value.(*fileCacheItem).size
+}
+
+func (c *FileCache) removeFiles(hash string) {
+	os.Remove(c.path(hash, fileCacheMetaExt))
+	os.Remove(c.path(hash, fileCacheBodyExt))
+}
+
+func (c *FileCache) path(hash, ext string) string {
+	return filepath.Join(c.dir, hash+ext)
+}
+
+func fileCacheHash(key string) string {
+	return fileCacheSum([]byte(key))
+}
+
+func fileCacheSum(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
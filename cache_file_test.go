@@ -0,0 +1,150 @@
+package seo4ajax
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFileCache(t *testing.T) {
+	Convey("disk-backed snapshot cache", t, func() {
+		dir, err := ioutil.TempDir("", "seo4ajax")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		now := time.Now().Round(time.Second)
+		entry := func(body string) *CacheEntry {
+			return &CacheEntry{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": {"text/html"}},
+				Body:       []byte(body),
+				StoredAt:   now,
+				Expires:    now.Add(time.Hour),
+				ETag:       `"abc"`,
+			}
+		}
+
+		c, err := NewFileCache(FileCacheConfig{Dir: dir, MaxBytes: 10})
+		So(err, ShouldBeNil)
+
+		Convey("entries round trip", func() {
+			c.Set("/a", entry("aaaa"))
+			got, ok := c.Get("/a")
+			So(ok, ShouldBeTrue)
+			So(got.StatusCode, ShouldEqual, http.StatusOK)
+			So(got.Header, ShouldResemble, http.Header{"Content-Type": {"text/html"}})
+			So(string(got.Body), ShouldEqual, "aaaa")
+			So(got.StoredAt.Equal(now), ShouldBeTrue)
+			So(got.Expires.Equal(now.Add(time.Hour)), ShouldBeTrue)
+			So(got.ETag, ShouldEqual, `"abc"`)
+
+			c.Delete("/a")
+			_, ok = c.Get("/a")
+			So(ok, ShouldBeFalse)
+			files, err := ioutil.ReadDir(dir)
+			So(err, ShouldBeNil)
+			So(files, ShouldBeEmpty)
+		})
+
+		Convey("least recently used entries are evicted", func() {
+			c.Set("/a", entry("aaaa"))
+			c.Set("/b", entry("bbbb"))
+			_, ok := c.Get("/a")
+			So(ok, ShouldBeTrue)
+			c.Set("/c", entry("cccc"))
+
+			So(c.Len(), ShouldEqual, 2)
+			_, ok = c.Get("/b")
+			So(ok, ShouldBeFalse)
+
+			c.Set("/d", entry("01234567890"))
+			_, ok = c.Get("/d")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("entries survive a restart and leftovers are removed", func() {
+			c.Set("/a", entry("aaaa"))
+			So(ioutil.WriteFile(filepath.Join(dir, "x.body.123.tmp"), []byte("partial"), 0644), ShouldBeNil)
+			So(ioutil.WriteFile(filepath.Join(dir, "orphan.body"), []byte("orphan"), 0644), ShouldBeNil)
+			So(ioutil.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0644), ShouldBeNil)
+
+			c, err = NewFileCache(FileCacheConfig{Dir: dir, MaxBytes: 10})
+			So(err, ShouldBeNil)
+			So(c.Len(), ShouldEqual, 1)
+			got, ok := c.Get("/a")
+			So(ok, ShouldBeTrue)
+			So(string(got.Body), ShouldEqual, "aaaa")
+
+			files, err := ioutil.ReadDir(dir)
+			So(err, ShouldBeNil)
+			So(len(files), ShouldEqual, 2)
+		})
+
+		Convey("entries of former versions are removed", func() {
+			hash := fileCacheHash("/old")
+			meta := `{"key":"/old","status_code":200,"etag":"\"upstream\"","size":3}`
+			So(ioutil.WriteFile(filepath.Join(dir, hash+".json"), []byte(meta), 0644), ShouldBeNil)
+			So(ioutil.WriteFile(filepath.Join(dir, hash+".body"), []byte("old"), 0644), ShouldBeNil)
+
+			c, err = NewFileCache(FileCacheConfig{Dir: dir})
+			So(err, ShouldBeNil)
+			So(c.Len(), ShouldEqual, 0)
+			_, ok := c.Get("/old")
+			So(ok, ShouldBeFalse)
+
+			files, err := ioutil.ReadDir(dir)
+			So(err, ShouldBeNil)
+			So(files, ShouldBeEmpty)
+		})
+
+		Convey("corrupted bodies are removed", func() {
+			c.Set("/a", entry("aaaa"))
+			So(ioutil.WriteFile(filepath.Join(dir, fileCacheHash("/a")+".body"), []byte("xxxx"), 0644), ShouldBeNil)
+
+			_, ok := c.Get("/a")
+			So(ok, ShouldBeFalse)
+			So(c.Len(), ShouldEqual, 0)
+			files, err := ioutil.ReadDir(dir)
+			So(err, ShouldBeNil)
+			So(files, ShouldBeEmpty)
+		})
+
+		Convey("concurrent writes of the same key are consistent", func() {
+			var (
+				wg         sync.WaitGroup
+				mismatches int32
+			)
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(body string) {
+					defer wg.Done()
+					for j := 0; j < 50; j++ {
+						e := entry(body)
+						e.ETag = body
+						c.Set("/a", e)
+						if got, ok := c.Get("/a"); ok && got.ETag != string(got.Body) {
+							atomic.AddInt32(&mismatches, 1)
+						}
+					}
+				}(strings.Repeat(string(rune('a'+i)), 4))
+			}
+			wg.Wait()
+
+			So(atomic.LoadInt32(&mismatches), ShouldEqual, 0)
+			So(c.Len(), ShouldBeLessThanOrEqualTo, 1)
+		})
+
+		Convey("a directory is required", func() {
+			_, err := NewFileCache(FileCacheConfig{})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
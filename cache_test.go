@@ -0,0 +1,174 @@
+package seo4ajax
+
+import (
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMemoryCache(t *testing.T) {
+	Convey("LRU eviction", t, func() {
+		entry := func(body string) *CacheEntry {
+			return &CacheEntry{StatusCode: http.StatusOK, Body: []byte(body)}
+		}
+
+		Convey("by entry count", func() {
+			c := NewMemoryCache(2, 0)
+			c.Set("a", entry("a"))
+			c.Set("b", entry("b"))
+			_, ok := c.Get("a")
+			So(ok, ShouldBeTrue)
+			c.Set("c", entry("c"))
+
+			So(c.Len(), ShouldEqual, 2)
+			_, ok = c.Get("b")
+			So(ok, ShouldBeFalse)
+			_, ok = c.Get("a")
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("by size", func() {
+			c := NewMemoryCache(0, 10)
+			c.Set("a", entry("12345"))
+			c.Set("b", entry("12345"))
+			c.Set("c", entry("1"))
+			So(c.Len(), ShouldEqual, 2)
+			_, ok := c.Get("a")
+			So(ok, ShouldBeFalse)
+
+			c.Set("d", entry("12345678901"))
+			_, ok = c.Get("d")
+			So(ok, ShouldBeFalse)
+
+			c.Delete("b")
+			So(c.Len(), ShouldEqual, 1)
+		})
+	})
+
+	Convey("TTL from caching headers", t, func() {
+		now := time.Now()
+		for _, tc := range []struct {
+			header http.Header
+			ttl    time.Duration
+			ok     bool
+		}{
+			{http.Header{}, time.Minute, true},
+			{http.Header{"Cache-Control": {"public, max-age=30"}}, 30 * time.Second, true},
+			{http.Header{"Cache-Control": {"max-age=30, s-maxage=60"}}, time.Minute, true},
+			{http.Header{"Cache-Control": {"max-age=0"}}, 0, false},
+			{http.Header{"Cache-Control": {"no-store"}}, 0, false},
+			{http.Header{"Cache-Control": {"private, max-age=60"}}, 0, false},
+			{http.Header{"Expires": {now.Add(time.Hour).UTC().Format(http.TimeFormat)}, "Date": {now.UTC().Format(http.TimeFormat)}}, time.Hour, true},
+			{http.Header{"Expires": {"0"}}, 0, false},
+		} {
+			ttl, ok := cacheTTL(tc.header, now, time.Minute)
+			So(ok, ShouldEqual, tc.ok)
+			So(ttl, ShouldEqual, tc.ttl)
+		}
+	})
+
+	Convey("snapshots are served from the cache", t, func() {
+		var hits int
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits++
+			if strings.Contains(r.URL.Path, "nocache") {
+				w.Header().Set("Cache-Control", "no-store")
+			}
+			w.Write([]byte("snapshot " + r.Header.Get("Accept-Language")))
+		}))
+		defer ts.Close()
+
+		seo4ajaxClient, err := New(Config{
+			Token:     "123",
+			Server:    ts.URL,
+			Cache:     NewMemoryCache(10, 1<<20),
+			CacheVary: []string{"accept-language"},
+		})
+		So(err, ShouldBeNil)
+
+		get := func(path, lang string) *httptest.ResponseRecorder {
+			req, err := http.NewRequest("GET", "http://"+appAdress+path+"?_escaped_fragment_=", nil)
+			So(err, ShouldBeNil)
+			req.Header.Set("Accept-Language", lang)
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		recorder := get("/page", "de")
+		So(recorder.Header().Get("X-Cache"), ShouldEqual, CacheMiss)
+		So(recorder.Body.String(), ShouldEqual, "snapshot de")
+
+		recorder = get("/page", "de")
+		So(recorder.Header().Get("X-Cache"), ShouldEqual, CacheHit)
+		So(recorder.Body.String(), ShouldEqual, "snapshot de")
+		So(hits, ShouldEqual, 1)
+
+		recorder = get("/page", "en")
+		So(recorder.Header().Get("X-Cache"), ShouldEqual, CacheMiss)
+		So(recorder.Body.String(), ShouldEqual, "snapshot en")
+		So(hits, ShouldEqual, 2)
+
+		get("/nocache", "de")
+		recorder = get("/nocache", "de")
+		So(recorder.Header().Get("X-Cache"), ShouldEqual, CacheMiss)
+		So(hits, ShouldEqual, 4)
+	})
+}
+
+func TestCacheContentEncoding(t *testing.T) {
+	Convey("compressed snapshots", t, func() {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/123/brotli" {
+				w.Header().Set("Content-Encoding", "br")
+				w.Write([]byte("compressed"))
+				return
+			}
+			if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+				w.Write([]byte("snapshot"))
+				return
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte("snapshot"))
+			gz.Close()
+		}))
+		defer ts.Close()
+
+		cache := NewMemoryCache(10, 0)
+		seo4ajaxClient, err := New(Config{Token: "123", Server: ts.URL, Cache: cache})
+		So(err, ShouldBeNil)
+		get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+			req, err := http.NewRequest("GET", "http://"+appAdress+path+"?_escaped_fragment_=", nil)
+			So(err, ShouldBeNil)
+			if acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", acceptEncoding)
+			}
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		Convey("are decoded before caching", func() {
+			recorder := get("/page", "gzip")
+			So(recorder.Header().Get("Content-Encoding"), ShouldBeEmpty)
+			So(recorder.Body.String(), ShouldEqual, "snapshot")
+
+			recorder = get("/page", "")
+			So(recorder.Header().Get("X-Cache"), ShouldEqual, CacheHit)
+			So(recorder.Header().Get("Content-Encoding"), ShouldBeEmpty)
+			So(recorder.Body.String(), ShouldEqual, "snapshot")
+		})
+
+		Convey("aren't cached if still encoded", func() {
+			recorder := get("/brotli", "br")
+			So(recorder.Header().Get("Content-Encoding"), ShouldEqual, "br")
+			So(cache.Len(), ShouldEqual, 0)
+		})
+	})
+}
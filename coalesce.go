@@ -0,0 +1,124 @@
+package seo4ajax
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// flight is an upstream fetch shared by concurrent requests for the same page
+type flight struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+
+	// set before done is closed
+	statusCode int
+	header     http.Header
+	body       []byte
+	err        error
+}
+
+type flights struct {
+	mu sync.Mutex
+	m  map[string]*flight
+}
+
+// fetchCoalesced fetches the page like Fetch, but concurrent calls with the same key and the same
+// conditional headers share a single upstream fetch. The shared fetch is cancelled once all
+// waiting callers are cancelled. Snapshots larger than both MaxBufferSize and MaxSnapshotSize fail
+func (c *Client) fetchCoalesced(ctx context.Context, key string, u *url.URL, header http.Header) (*Page, error) {
+	key = c.flightKey(key, header)
+
+	c.flights.mu.Lock()
+	f, ok := c.flights.m[key]
+	if !ok {
+		fctx, cancel := context.WithCancel(context.Background())
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		c.flights.m[key] = f
+
+		cpy := *u
+		go c.fly(fctx, key, f, &cpy, header.Clone())
+	}
+	f.waiters++
+	c.flights.mu.Unlock()
+
+	select {
+	case <-f.done:
+		c.leave(key, f)
+		if f.err != nil {
+			return nil, f.err
+		}
+		return &Page{
+			StatusCode:    f.statusCode,
+			Header:        f.header.Clone(),
+			Body:          ioutil.NopCloser(bytes.NewReader(f.body)),
+			ContentLength: int64(len(f.body)),
+		}, nil
+	case <-ctx.Done():
+		c.leave(key, f)
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) fly(ctx context.Context, key string, f *flight, u *url.URL, header http.Header) {
+	defer f.cancel()
+
+	page, err := c.Fetch(ctx, u, header)
+	if err == nil {
+		f.statusCode = page.StatusCode
+		f.header = page.Header
+		limit := c.maxBufferSize
+		if c.maxSnapshotSize > limit {
+			limit = c.maxSnapshotSize
+		}
+		f.body, err = ioutil.ReadAll(io.LimitReader(page.Body, limit+1))
+		page.Body.Close()
+		if err == nil && int64(len(f.body)) > limit {
+			// a streamed body can't be shared
+			err = &UpstreamError{StatusCode: page.StatusCode, Err: &SnapshotError{
+				ContentType: page.Header.Get("Content-Type"),
+				Size:        int64(len(f.body)),
+				Err:         ErrSnapshotTooLarge,
+			}}
+		}
+	}
+	f.err = err
+
+	c.flights.mu.Lock()
+	if c.flights.m[key] == f {
+		delete(c.flights.m, key)
+	}
+	c.flights.mu.Unlock()
+	close(f.done)
+}
+
+// flightKey extends the key by the conditional headers, as they change the response. Other
+// forwarded headers like X-Forwarded-For are ignored, the flight is sent with the ones of the
+// first caller
+func (c *Client) flightKey(key string, header http.Header) string {
+	for _, name := range []string{"If-None-Match", "If-Modified-Since"} {
+		key += "\n" + name + ":" + strings.Join(header[name], ",")
+	}
+	return key
+}
+
+// leave removes a waiter from the flight, cancelling it if nobody is waiting anymore
+func (c *Client) leave(key string, f *flight) {
+	c.flights.mu.Lock()
+	defer c.flights.mu.Unlock()
+
+	f.waiters--
+	if f.waiters > 0 {
+		return
+	}
+	f.cancel()
+	if c.flights.m[key] == f {
+		delete(c.flights.m, key)
+	}
+}
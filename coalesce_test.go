@@ -0,0 +1,156 @@
+package seo4ajax
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCoalesce(t *testing.T) {
+	Convey("concurrent fetches of the same page", t, func() {
+		var hits int32
+		release := make(chan struct{})
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				return
+			}
+			if r.Header.Get("If-None-Match") != "" {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write([]byte("snapshot " + r.URL.Path))
+		}))
+		defer ts.Close()
+
+		seo4ajaxClient, err := New(Config{Token: "123", Server: ts.URL, Coalesce: true})
+		So(err, ShouldBeNil)
+
+		Convey("share a single upstream request", func() {
+			var wg sync.WaitGroup
+			bodies := make([]string, 10)
+			for i := range bodies {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					req, _ := http.NewRequest("GET", "http://"+appAdress+"/page?_escaped_fragment_=", nil)
+					recorder := httptest.NewRecorder()
+					seo4ajaxClient.ServeHTTP(recorder, req)
+					bodies[i] = recorder.Body.String()
+				}(i)
+			}
+			time.Sleep(100 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			So(atomic.LoadInt32(&hits), ShouldEqual, 1)
+			for _, body := range bodies {
+				So(body, ShouldEqual, "snapshot /123/page")
+			}
+		})
+
+		Convey("don't share fetches with different upstream headers", func() {
+			results := make(chan int, 2)
+			for _, header := range []http.Header{{"If-None-Match": {`"a"`}}, {}} {
+				go func(header http.Header) {
+					page, err := seo4ajaxClient.fetchCoalesced(context.Background(), "/page", &url.URL{Path: "/page"}, header)
+					if err != nil {
+						results <- 0
+						return
+					}
+					page.Body.Close()
+					results <- page.StatusCode
+				}(header)
+			}
+			time.Sleep(100 * time.Millisecond)
+			close(release)
+
+			statuses := map[int]bool{<-results: true, <-results: true}
+			So(statuses, ShouldResemble, map[int]bool{http.StatusOK: true, http.StatusNotModified: true})
+			So(atomic.LoadInt32(&hits), ShouldEqual, 2)
+		})
+
+		Convey("share fetches of requests with different client headers", func() {
+			var wg sync.WaitGroup
+			codes := make([]int, 2)
+			for i := range codes {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					req, _ := http.NewRequest("GET", "http://"+appAdress+"/page?_escaped_fragment_=", nil)
+					req.Header.Set("X-Forwarded-For", fmt.Sprintf("10.0.0.%d", i+1))
+					req.Header.Set("X-Request-Id", fmt.Sprintf("request-%d", i))
+					recorder := httptest.NewRecorder()
+					seo4ajaxClient.ServeHTTP(recorder, req)
+					codes[i] = recorder.Code
+				}(i)
+			}
+			time.Sleep(100 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			So(atomic.LoadInt32(&hits), ShouldEqual, 1)
+			So(codes, ShouldResemble, []int{http.StatusOK, http.StatusOK})
+		})
+
+		Convey("fail for snapshots exceeding the buffer size", func() {
+			seo4ajaxClient.maxBufferSize = 4
+			close(release)
+			_, err := seo4ajaxClient.fetchCoalesced(context.Background(), "/page", &url.URL{Path: "/page"}, nil)
+			So(errors.Is(err, ErrSnapshotTooLarge), ShouldBeTrue)
+		})
+
+		Convey("waiters cancel independently", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancelled := make(chan error)
+			go func() {
+				_, err := seo4ajaxClient.fetchCoalesced(ctx, "/page", &url.URL{Path: "/page"}, nil)
+				cancelled <- err
+			}()
+
+			result := make(chan string)
+			go func() {
+				page, err := seo4ajaxClient.fetchCoalesced(context.Background(), "/page", &url.URL{Path: "/page"}, nil)
+				if err != nil {
+					result <- err.Error()
+					return
+				}
+				body, _ := ioutil.ReadAll(page.Body)
+				result <- string(body)
+			}()
+
+			time.Sleep(100 * time.Millisecond)
+			cancel()
+			So(<-cancelled, ShouldEqual, context.Canceled)
+			close(release)
+			So(<-result, ShouldEqual, "snapshot /123/page")
+			So(atomic.LoadInt32(&hits), ShouldEqual, 1)
+		})
+
+		Convey("the upstream request is cancelled once all waiters are gone", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(100*time.Millisecond, cancel)
+			_, err := seo4ajaxClient.fetchCoalesced(ctx, "/page", &url.URL{Path: "/page"}, nil)
+			So(err, ShouldEqual, context.Canceled)
+
+			close(release)
+			page, err := seo4ajaxClient.fetchCoalesced(context.Background(), "/page", &url.URL{Path: "/page"}, nil)
+			So(err, ShouldBeNil)
+			body, _ := ioutil.ReadAll(page.Body)
+			So(string(body), ShouldEqual, "snapshot /123/page")
+			So(atomic.LoadInt32(&hits), ShouldEqual, 2)
+		})
+	})
+}
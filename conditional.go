@@ -0,0 +1,107 @@
+package seo4ajax
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CacheRevalidated is reported in the CacheStatusHeader if seo4ajax confirmed an expired
+// snapshot to be unchanged
+const CacheRevalidated = "REVALIDATED"
+
+// snapshotETag returns a strong entity tag derived from the snapshot body
+func snapshotETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// lastModified returns the Last-Modified time of the snapshot, the time it was stored if
+// seo4ajax didn't send one
+func (e *CacheEntry) lastModified() time.Time {
+	if t, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil {
+		return t
+	}
+	return e.StoredAt
+}
+
+// upstreamHeader returns the request header sent to seo4ajax. With a cache, conditional requests
+// of crawlers are answered locally, so their validators are replaced by the ones seo4ajax sent
+// along with the cached snapshot
+func (c *Client) upstreamHeader(h http.Header, cached *CacheEntry) http.Header {
+	if c.cache == nil {
+		return h
+	}
+	h = h.Clone()
+	h.Del("If-None-Match")
+	h.Del("If-Modified-Since")
+	if cached == nil || cached.StatusCode != http.StatusOK || !c.relayStatus[http.StatusNotModified] {
+		return h
+	}
+	if etag := cached.Header.Get("ETag"); etag != "" {
+		h.Set("If-None-Match", etag)
+	}
+	if lastModified := cached.Header.Get("Last-Modified"); lastModified != "" {
+		h.Set("If-Modified-Since", lastModified)
+	}
+	return h
+}
+
+// refreshEntry updates the cached snapshot confirmed by a 304 response with its headers and
+// returns the refreshed entry. The body, ETag and StoredAt are kept as the snapshot is unchanged
+func (c *Client) refreshEntry(key string, entry *CacheEntry, page *Page) *CacheEntry {
+	header := entry.Header.Clone()
+	for k, v := range page.Header {
+		if k != "Content-Length" {
+			header[k] = v
+		}
+	}
+	now := time.Now()
+	refreshed := &CacheEntry{
+		StatusCode: entry.StatusCode,
+		Header:     header,
+		Body:       entry.Body,
+		StoredAt:   entry.StoredAt,
+		Expires:    now,
+		ETag:       entry.ETag,
+	}
+	ttl, ok := cacheTTL(header, now, c.cacheTTL)
+	if !ok {
+		c.cache.Delete(key)
+		return refreshed
+	}
+	refreshed.Expires = now.Add(ttl)
+	c.cache.Set(key, refreshed)
+	return refreshed
+}
+
+// notModified reports whether the conditional headers of the request match the validators of the
+// snapshot. If-None-Match takes precedence over If-Modified-Since as defined in RFC 7232
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if values := r.Header["If-None-Match"]; len(values) > 0 {
+		return etagMatch(strings.Join(values, ","), etag)
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || lastModified.IsZero() {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(since)
+}
+
+// etagMatch reports whether the If-None-Match list contains the entity tag, using the weak
+// comparison
+func etagMatch(list, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package seo4ajax
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConditionalRequests(t *testing.T) {
+	Convey("with a cache", t, func() {
+		var (
+			mu          sync.Mutex
+			hits        int
+			conditional []string
+		)
+		lastModified := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			hits++
+			conditional = append(conditional, r.Header.Get("If-None-Match"))
+			mu.Unlock()
+			w.Header().Set("Cache-Control", "max-age=60")
+			if r.Header.Get("If-None-Match") == `"upstream"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"upstream"`)
+			w.Header().Set("Last-Modified", lastModified)
+			w.Write([]byte("snapshot"))
+		}))
+		defer ts.Close()
+
+		cache := NewMemoryCache(10, 0)
+		seo4ajaxClient, err := New(Config{Token: "123", Server: ts.URL, Cache: cache})
+		So(err, ShouldBeNil)
+
+		get := func(header http.Header) *httptest.ResponseRecorder {
+			req, err := http.NewRequest("GET", "http://"+appAdress+"/page?_escaped_fragment_=", nil)
+			So(err, ShouldBeNil)
+			for k, v := range header {
+				req.Header[k] = v
+			}
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		recorder := get(http.Header{"If-None-Match": {`"upstream"`}})
+		So(recorder.Code, ShouldEqual, http.StatusOK)
+		etag := recorder.Header().Get("ETag")
+		So(etag, ShouldEqual, snapshotETag([]byte("snapshot")))
+		So(recorder.Header().Get("Last-Modified"), ShouldEqual, lastModified)
+		So(conditional, ShouldResemble, []string{""})
+
+		Convey("matching validators are answered with 304 locally", func() {
+			recorder := get(http.Header{"If-None-Match": {`"other", ` + etag}})
+			So(recorder.Code, ShouldEqual, http.StatusNotModified)
+			So(recorder.Header().Get("ETag"), ShouldEqual, etag)
+			So(recorder.Body.Len(), ShouldEqual, 0)
+
+			recorder = get(http.Header{"If-Modified-Since": {lastModified}})
+			So(recorder.Code, ShouldEqual, http.StatusNotModified)
+			So(hits, ShouldEqual, 1)
+		})
+
+		Convey("other validators get the snapshot", func() {
+			recorder := get(http.Header{"If-None-Match": {`"other"`}})
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(recorder.Body.String(), ShouldEqual, "snapshot")
+
+			recorder = get(http.Header{"If-Modified-Since": {time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC).Format(http.TimeFormat)}})
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("expired snapshots are revalidated with the upstream validators", func() {
+			key := seo4ajaxClient.cacheKey(httptest.NewRequest("GET", "/page?_escaped_fragment_=", nil))
+			entry, ok := cache.Get(key)
+			So(ok, ShouldBeTrue)
+			expired := *entry
+			expired.Expires = time.Now().Add(-time.Second)
+			cache.Set(key, &expired)
+
+			recorder := get(nil)
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(recorder.Header().Get("X-Cache"), ShouldEqual, CacheRevalidated)
+			So(recorder.Header().Get("ETag"), ShouldEqual, etag)
+			So(recorder.Body.String(), ShouldEqual, "snapshot")
+			So(conditional, ShouldResemble, []string{"", `"upstream"`})
+
+			recorder = get(nil)
+			So(recorder.Header().Get("X-Cache"), ShouldEqual, CacheHit)
+			So(hits, ShouldEqual, 2)
+		})
+	})
+
+	Convey("etags", t, func() {
+		So(etagMatch(`"a"`, `"a"`), ShouldBeTrue)
+		So(etagMatch(`W/"a"`, `"a"`), ShouldBeTrue)
+		So(etagMatch(`"b", "a"`, `"a"`), ShouldBeTrue)
+		So(etagMatch(`*`, `"a"`), ShouldBeTrue)
+		So(etagMatch(`"b"`, `"a"`), ShouldBeFalse)
+		So(snapshotETag([]byte("a")), ShouldNotEqual, snapshotETag([]byte("b")))
+	})
+}
@@ -0,0 +1,222 @@
+package seo4ajax
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var (
+	regexInvalidUserAgent = regexp.MustCompile(`(?i:bing|msnbot|yandexbot|pinterest.*ios|mail\.ru)`)
+	regexValidUserAgent   = regexp.MustCompile(`(?i:bot|google|crawler|spider|archiver|pinterest|facebookexternalhit|flipboardproxy)`)
+	regexFilePath         = regexp.MustCompile(`.*(\.[^?]{2,4}$|\.[^?]{2,4}?.*)`)
+	regexIndexHTML        = regexp.MustCompile(`/index\.html?`)
+)
+
+// Detector decides whether a request shall be served by Seo4Ajax
+type Detector interface {
+	Detect(r *http.Request) Decision
+}
+
+// DetectorFunc is an adapter to allow the use of ordinary functions as Detector
+type DetectorFunc func(r *http.Request) Decision
+
+// Detect calls f(r)
+func (f DetectorFunc) Detect(r *http.Request) Decision {
+	return f(r)
+}
+
+// Rule names the detection rule which lead to a Decision
+type Rule string
+
+// Rules of the DefaultDetector
+const (
+	// RuleMethod rejects requests other than GET and HEAD
+	RuleMethod Rule = "method"
+	// RuleEscapedFragment accepts requests with an _escaped_fragment_ query parameter
+	RuleEscapedFragment Rule = "escaped_fragment"
+	// RuleDeniedUserAgent rejects user agents matching DenyUserAgents
+	RuleDeniedUserAgent Rule = "denied_user_agent"
+	// RuleInvalidUserAgent rejects user agents on the built-in deny list
+	RuleInvalidUserAgent Rule = "invalid_user_agent"
+	// RuleFilePath rejects paths pointing to static files
+	RuleFilePath Rule = "file_path"
+	// RuleIndexHTML accepts crawlers requesting index.html, which would otherwise be a file path
+	RuleIndexHTML Rule = "index_html"
+	// RuleAllowedUserAgent accepts user agents matching AllowUserAgents
+	RuleAllowedUserAgent Rule = "allowed_user_agent"
+	// RuleValidUserAgent accepts user agents on the built-in allow list
+	RuleValidUserAgent Rule = "valid_user_agent"
+	// RuleUnknownUserAgent rejects user agents not matching any allow list
+	RuleUnknownUserAgent Rule = "unknown_user_agent"
+	// RuleUnverifiedCrawler rejects crawlers failing the Verifier of the Client
+	RuleUnverifiedCrawler Rule = "unverified_crawler"
+)
+
+// Decision is the result of a Detector
+type Decision struct {
+	// Prerender is true if the request shall be served by Seo4Ajax
+	Prerender bool
+	// Rule is the rule which made the decision, it may be empty for custom detectors
+	Rule Rule
+}
+
+// String formats the decision for logs and debug headers, e.g. "prerender (valid_user_agent)"
+func (d Decision) String() string {
+	s := "passthrough"
+	if d.Prerender {
+		s = "prerender"
+	}
+	if d.Rule != "" {
+		s += " (" + string(d.Rule) + ")"
+	}
+	return s
+}
+
+// MatchType selects how a UserAgentPattern is matched against the User-Agent header
+type MatchType int
+
+const (
+	// MatchSubstring matches if the User-Agent contains the pattern, ignoring case
+	MatchSubstring MatchType = iota
+	// MatchRegexp matches if the regular expression matches the User-Agent
+	MatchRegexp
+	// MatchExact matches if the User-Agent equals the pattern
+	MatchExact
+)
+
+// UserAgentPattern is a user agent allow or deny list entry
+type UserAgentPattern struct {
+	Match   MatchType
+	Pattern string
+}
+
+type userAgentMatcher func(ua string) bool
+
+func (p UserAgentPattern) compile() (userAgentMatcher, error) {
+	if p.Pattern == "" {
+		return nil, errors.New("empty pattern")
+	}
+	switch p.Match {
+	case MatchSubstring:
+		pattern := strings.ToLower(p.Pattern)
+		return func(ua string) bool {
+			return strings.Contains(strings.ToLower(ua), pattern)
+		}, nil
+	case MatchRegexp:
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	case MatchExact:
+		pattern := p.Pattern
+		return func(ua string) bool {
+			return ua == pattern
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown match type %d", p.Match)
+}
+
+func compileUserAgentPatterns(kind string, patterns []UserAgentPattern) ([]userAgentMatcher, error) {
+	matchers := make([]userAgentMatcher, 0, len(patterns))
+	for i, p := range patterns {
+		m, err := p.compile()
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s user agent pattern #%d %q: %v", kind, i, p.Pattern, err)
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+func matchUserAgent(matchers []userAgentMatcher, ua string) bool {
+	for _, m := range matchers {
+		if m(ua) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultDetector is the Detector used if none is configured.
+// The logic is taken from https://github.com/seo4ajax/connect-s4a/blob/master/lib/connect-s4a.js
+// The zero value uses the built-in user agent lists only, use NewDefaultDetector to extend or replace them.
+type DefaultDetector struct {
+	allow   []userAgentMatcher
+	deny    []userAgentMatcher
+	replace bool
+}
+
+// NewDefaultDetector returns a DefaultDetector with additional allowed and denied user agents.
+// Denied user agents take precedence over allowed ones, allowed user agents take precedence over
+// the built-in lists. If replace is true the built-in user agent lists are not used at all.
+func NewDefaultDetector(allow, deny []UserAgentPattern, replace bool) (DefaultDetector, error) {
+	allowMatchers, err := compileUserAgentPatterns("allowed", allow)
+	if err != nil {
+		return DefaultDetector{}, err
+	}
+	denyMatchers, err := compileUserAgentPatterns("denied", deny)
+	if err != nil {
+		return DefaultDetector{}, err
+	}
+	return DefaultDetector{
+		allow:   allowMatchers,
+		deny:    denyMatchers,
+		replace: replace,
+	}, nil
+}
+
+// Detect implements Detector
+func (d DefaultDetector) Detect(r *http.Request) Decision {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return Decision{Rule: RuleMethod}
+	}
+
+	if strings.Contains(r.URL.RawQuery, "_escaped_fragment_") {
+		return Decision{Prerender: true, Rule: RuleEscapedFragment}
+	}
+
+	ua := r.Header.Get("User-Agent")
+	if matchUserAgent(d.deny, ua) {
+		return Decision{Rule: RuleDeniedUserAgent}
+	}
+
+	allowed := matchUserAgent(d.allow, ua)
+	if !allowed && !d.replace && regexInvalidUserAgent.MatchString(ua) {
+		return Decision{Rule: RuleInvalidUserAgent}
+	}
+
+	indexHTML := regexIndexHTML.MatchString(r.URL.Path)
+	if !indexHTML && regexFilePath.MatchString(r.URL.Path) {
+		return Decision{Rule: RuleFilePath}
+	}
+
+	var rule Rule
+	switch {
+	case allowed:
+		rule = RuleAllowedUserAgent
+	case !d.replace && regexValidUserAgent.MatchString(ua):
+		rule = RuleValidUserAgent
+	default:
+		return Decision{Rule: RuleUnknownUserAgent}
+	}
+	if indexHTML && regexFilePath.MatchString(r.URL.Path) {
+		rule = RuleIndexHTML
+	}
+	return Decision{Prerender: true, Rule: rule}
+}
+
+// ExplainPrerender returns the decision of the DefaultDetector for the given http Request,
+// including the rule which made it
+func ExplainPrerender(r *http.Request) Decision {
+	return DefaultDetector{}.Detect(r)
+}
+
+// IsPrerender returns true, when Seo4Ajax shall be used for the given http Request.
+// It is a shorthand for ExplainPrerender(r).Prerender
+func IsPrerender(r *http.Request) bool {
+	return ExplainPrerender(r).Prerender
+}
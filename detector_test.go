@@ -0,0 +1,199 @@
+package seo4ajax
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDetector(t *testing.T) {
+	Convey("custom detector is consulted by ServeHTTP", t, func() {
+		var hits int
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits++
+		}))
+		defer ts.Close()
+
+		seo4ajaxClient, err := New(Config{
+			Token:  "123",
+			Server: ts.URL,
+			Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			}),
+			Detector: DetectorFunc(func(r *http.Request) Decision {
+				return Decision{Prerender: r.Header.Get("X-Prerender") != ""}
+			}),
+		})
+		So(err, ShouldBeNil)
+
+		Convey("detector says prerender", func() {
+			req, err := http.NewRequest("GET", "http://"+appAdress+"/path", nil)
+			So(err, ShouldBeNil)
+			req.Header.Set("X-Prerender", "1")
+			So(IsPrerender(req), ShouldBeFalse)
+
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, req)
+			So(hits, ShouldEqual, 1)
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("detector says no prerender", func() {
+			req, err := http.NewRequest("GET", "http://"+appAdress+"/path", nil)
+			So(err, ShouldBeNil)
+			req.Header.Set("User-Agent", "Googlebot")
+			So(IsPrerender(req), ShouldBeTrue)
+
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, req)
+			So(hits, ShouldEqual, 0)
+			So(recorder.Code, ShouldEqual, http.StatusTeapot)
+		})
+	})
+
+	Convey("IsPrerender matches DefaultDetector", t, func() {
+		req, err := http.NewRequest("GET", "http://"+appAdress+"/path?_escaped_fragment_=", nil)
+		So(err, ShouldBeNil)
+		So(DefaultDetector{}.Detect(req), ShouldResemble, Decision{Prerender: true, Rule: RuleEscapedFragment})
+		So(IsPrerender(req), ShouldBeTrue)
+	})
+
+	Convey("user agent allow and deny lists", t, func() {
+		bing := "Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)"
+		google := "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+		newReq := func(ua string) *http.Request {
+			req, err := http.NewRequest("GET", "http://"+appAdress+"/path/subpath", nil)
+			So(err, ShouldBeNil)
+			req.Header.Set("User-Agent", ua)
+			return req
+		}
+
+		Convey("allowed substring overrides built-in deny list", func() {
+			d, err := NewDefaultDetector([]UserAgentPattern{{Match: MatchSubstring, Pattern: "BingBot"}}, nil, false)
+			So(err, ShouldBeNil)
+			So(d.Detect(newReq(bing)).Prerender, ShouldBeTrue)
+			So(d.Detect(newReq(google)).Prerender, ShouldBeTrue)
+		})
+
+		Convey("denied regexp overrides built-in allow list", func() {
+			d, err := NewDefaultDetector(nil, []UserAgentPattern{{Match: MatchRegexp, Pattern: `(?i)googlebot/\d`}}, false)
+			So(err, ShouldBeNil)
+			So(d.Detect(newReq(google)).Prerender, ShouldBeFalse)
+			So(d.Detect(newReq("Twitterbot/1.0")).Prerender, ShouldBeTrue)
+		})
+
+		Convey("deny takes precedence over allow", func() {
+			d, err := NewDefaultDetector(
+				[]UserAgentPattern{{Match: MatchSubstring, Pattern: "bot"}},
+				[]UserAgentPattern{{Match: MatchExact, Pattern: "Twitterbot/1.0"}},
+				false,
+			)
+			So(err, ShouldBeNil)
+			So(d.Detect(newReq("Twitterbot/1.0")).Prerender, ShouldBeFalse)
+			So(d.Detect(newReq("Twitterbot/1.1")).Prerender, ShouldBeTrue)
+		})
+
+		Convey("replace drops built-in lists", func() {
+			d, err := NewDefaultDetector([]UserAgentPattern{{Match: MatchExact, Pattern: "MyCrawler"}}, nil, true)
+			So(err, ShouldBeNil)
+			So(d.Detect(newReq("MyCrawler")).Prerender, ShouldBeTrue)
+			So(d.Detect(newReq(google)).Prerender, ShouldBeFalse)
+			So(d.Detect(newReq(bing)).Prerender, ShouldBeFalse)
+		})
+
+		Convey("file paths are still excluded", func() {
+			d, err := NewDefaultDetector([]UserAgentPattern{{Match: MatchSubstring, Pattern: "bing"}}, nil, false)
+			So(err, ShouldBeNil)
+			req, err := http.NewRequest("GET", "http://"+appAdress+"/app.js", nil)
+			So(err, ShouldBeNil)
+			req.Header.Set("User-Agent", bing)
+			So(d.Detect(req).Prerender, ShouldBeFalse)
+		})
+
+		Convey("invalid patterns are rejected by New", func() {
+			_, err := New(Config{
+				Token:          "123",
+				DenyUserAgents: []UserAgentPattern{{Match: MatchRegexp, Pattern: "("}},
+			})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "invalid denied user agent pattern #0")
+
+			_, err = New(Config{
+				Token:           "123",
+				AllowUserAgents: []UserAgentPattern{{Match: MatchSubstring}},
+			})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "empty pattern")
+		})
+
+		Convey("lists can't be combined with a custom detector", func() {
+			_, err := New(Config{
+				Token:           "123",
+				Detector:        DefaultDetector{},
+				AllowUserAgents: []UserAgentPattern{{Pattern: "bing"}},
+			})
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("ExplainPrerender reports the deciding rule", t, func() {
+		for _, tc := range []struct {
+			method, url, ua string
+			want            Decision
+		}{
+			{"POST", "/path", "Googlebot", Decision{Rule: RuleMethod}},
+			{"GET", "/path?_escaped_fragment_=", "", Decision{Prerender: true, Rule: RuleEscapedFragment}},
+			{"GET", "/path", "bingbot/2.0", Decision{Rule: RuleInvalidUserAgent}},
+			{"GET", "/app.js", "Googlebot", Decision{Rule: RuleFilePath}},
+			{"GET", "/index.html", "Googlebot", Decision{Prerender: true, Rule: RuleIndexHTML}},
+			{"GET", "/index.html", "Mozilla/5.0", Decision{Rule: RuleUnknownUserAgent}},
+			{"GET", "/path", "Googlebot", Decision{Prerender: true, Rule: RuleValidUserAgent}},
+			{"GET", "/path", "Mozilla/5.0", Decision{Rule: RuleUnknownUserAgent}},
+		} {
+			req, err := http.NewRequest(tc.method, "http://"+appAdress+tc.url, nil)
+			So(err, ShouldBeNil)
+			req.Header.Set("User-Agent", tc.ua)
+			So(ExplainPrerender(req), ShouldResemble, tc.want)
+		}
+
+		d, err := NewDefaultDetector(
+			[]UserAgentPattern{{Pattern: "bing"}},
+			[]UserAgentPattern{{Pattern: "twitter"}},
+			false,
+		)
+		So(err, ShouldBeNil)
+		req, err := http.NewRequest("GET", "http://"+appAdress+"/path", nil)
+		So(err, ShouldBeNil)
+		req.Header.Set("User-Agent", "bingbot/2.0")
+		So(d.Detect(req), ShouldResemble, Decision{Prerender: true, Rule: RuleAllowedUserAgent})
+		req.Header.Set("User-Agent", "Twitterbot/1.0")
+		So(d.Detect(req), ShouldResemble, Decision{Rule: RuleDeniedUserAgent})
+	})
+
+	Convey("decision is reported in the debug header", t, func() {
+		var logged int
+		seo4ajaxClient, err := New(Config{
+			Token:       "123",
+			DebugHeader: "X-Seo4ajax-Decision",
+			Log: log.LoggerFunc(func(keyvals ...interface{}) error {
+				logged++
+				return nil
+			}),
+			Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}),
+		})
+		So(err, ShouldBeNil)
+
+		req, err := http.NewRequest("GET", "http://"+appAdress+"/app.js", nil)
+		So(err, ShouldBeNil)
+		req.Header.Set("User-Agent", "Googlebot")
+		recorder := httptest.NewRecorder()
+		seo4ajaxClient.ServeHTTP(recorder, req)
+		So(recorder.Header().Get("X-Seo4ajax-Decision"), ShouldEqual, "passthrough (file_path)")
+		So(logged, ShouldEqual, 0)
+	})
+}
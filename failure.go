@@ -0,0 +1,57 @@
+package seo4ajax
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// FailurePolicy selects the response to requests whose snapshot couldn't be fetched
+type FailurePolicy int
+
+const (
+	// FailureError responds with an error status, see FetchErrorStatus and ErrorStatus
+	FailureError FailurePolicy = iota
+	// FailureNext passes the request to the Next handler, e.g. to serve the SPA shell, responding
+	// like FailureError if there is none
+	FailureNext
+	// FailureFallback passes the request to the FallbackHandler, e.g. a static page, responding
+	// like FailureError if there is none
+	FailureFallback
+)
+
+func (p FailurePolicy) String() string {
+	switch p {
+	case FailureError:
+		return "error"
+	case FailureNext:
+		return "next"
+	case FailureFallback:
+		return "fallback"
+	}
+	return "unknown"
+}
+
+// failed responds to a request whose snapshot couldn't be fetched according to the FailurePolicy
+func (c *Client) failed(w http.ResponseWriter, r *http.Request, err error) {
+	policy := c.failurePolicy
+	switch {
+	case policy == FailureNext && c.next == nil, policy == FailureFallback && c.fallback == nil:
+		policy = FailureError
+	}
+	c.log.Log("level", "info", "msg", "Prerender failed", "policy", policy, "path", r.URL.Path)
+
+	switch policy {
+	case FailureNext:
+		c.next.ServeHTTP(w, r)
+	case FailureFallback:
+		c.fallback.ServeHTTP(w, r)
+	default:
+		var upstreamErr *UpstreamError
+		if errors.As(err, &upstreamErr) && upstreamErr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(upstreamErr.RetryAfter.Seconds()))))
+		}
+		http.Error(w, "Upstream error", c.errorStatusFor(err))
+	}
+}
@@ -0,0 +1,64 @@
+package seo4ajax
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFailurePolicy(t *testing.T) {
+	Convey("failed prerenders", t, func() {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer ts.Close()
+
+		cfg := Config{
+			Token:   "123",
+			Server:  ts.URL,
+			Timeout: 10 * time.Millisecond,
+			Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("app shell"))
+			}),
+		}
+		get := func() *httptest.ResponseRecorder {
+			seo4ajaxClient, err := New(cfg)
+			So(err, ShouldBeNil)
+			req, err := http.NewRequest("GET", "http://"+appAdress+"/page?_escaped_fragment_=", nil)
+			So(err, ShouldBeNil)
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		Convey("respond with the error status by default", func() {
+			So(get().Code, ShouldEqual, http.StatusServiceUnavailable)
+		})
+
+		Convey("are passed to next", func() {
+			cfg.FailurePolicy = FailureNext
+			recorder := get()
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(recorder.Body.String(), ShouldEqual, "app shell")
+
+			cfg.Next = nil
+			So(get().Code, ShouldEqual, http.StatusServiceUnavailable)
+		})
+
+		Convey("are passed to the fallback handler", func() {
+			cfg.FailurePolicy = FailureFallback
+			cfg.FallbackHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("fallback"))
+			})
+			recorder := get()
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(recorder.Body.String(), ShouldEqual, "fallback")
+
+			cfg.FallbackHandler = nil
+			So(get().Code, ShouldEqual, http.StatusServiceUnavailable)
+		})
+	})
+}
@@ -0,0 +1,261 @@
+package seo4ajax
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+// Page is a prerendered page returned by seo4ajax
+type Page struct {
+	StatusCode int
+	Header     http.Header
+	// Body is the page content, it must be closed by the caller
+	Body io.ReadCloser
+	// ContentLength is the length of Body if it has been read completely, -1 if it is streamed
+	ContentLength int64
+
+	// validators of cached snapshots, conditional requests are answered locally if set
+	etag         string
+	lastModified time.Time
+}
+
+// UpstreamError is returned by Fetch if seo4ajax didn't deliver a page. Depending on the
+// upstream status it wraps ErrCacheMiss, ErrPageNotFound, ErrTooManyRequests or ErrUnknownStatus,
+// otherwise the transport error
+type UpstreamError struct {
+	// StatusCode is the status code of the last upstream response, 0 if there was none
+	StatusCode int
+	// Attempts is the number of upstream requests made
+	Attempts int
+	// Elapsed is the time spent fetching, including retries
+	Elapsed time.Duration
+	// RetryAfter is the delay requested by the Retry-After header of the last upstream response
+	// with status 429 or 503, 0 if there was none
+	RetryAfter time.Duration
+	// Err is the cause of the failure
+	Err error
+}
+
+func (e *UpstreamError) Error() string {
+	msg := "seo4ajax:"
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(" status %d", e.StatusCode)
+	}
+	if e.Attempts > 0 {
+		msg += fmt.Sprintf(" after %d attempts in %s", e.Attempts, e.Elapsed)
+	}
+	return fmt.Sprintf("%s: %v", msg, e.Err)
+}
+
+// Unwrap returns the cause of the failure
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+func statusError(statusCode int) *UpstreamError {
+	err := ErrUnknownStatus
+	switch statusCode {
+	case http.StatusServiceUnavailable:
+		err = ErrCacheMiss
+	case http.StatusNotFound:
+		err = ErrPageNotFound
+	case http.StatusTooManyRequests:
+		err = ErrTooManyRequests
+	}
+	return &UpstreamError{StatusCode: statusCode, Err: err}
+}
+
+// Fetch returns the prerendered page for u from the seo4ajax api. The given header is sent
+// upstream according to the RequestHeaders policy along with the server IP in X-Forwarded-For,
+// it is not modified. Accept-Encoding is left to the Transport, which decodes gzip bodies.
+// Failed fetches are retried according to the Retry policy until success or Timeout.
+// Cancelling ctx aborts the running attempt as well as the retry loop and returns the context
+// error. ErrOverloaded is returned if no slot became available within MaxConcurrentFetches,
+// the slot is held until the Body is closed.
+// ErrCircuitOpen is returned without contacting seo4ajax while the circuit breaker is open.
+// Responses with a relayed status code, by default DefaultRelayStatus, are returned as Page,
+// redirects along with their Location header.
+func (c *Client) Fetch(ctx context.Context, u *url.URL, header http.Header) (*Page, error) {
+	return c.do(ctx, http.MethodGet, u, header)
+}
+
+// FetchHead is like Fetch but sends a HEAD request, so seo4ajax doesn't deliver the snapshot.
+// The Body of the returned Page is empty, its ContentLength is the announced one
+func (c *Client) FetchHead(ctx context.Context, u *url.URL, header http.Header) (*Page, error) {
+	return c.do(ctx, http.MethodHead, u, header)
+}
+
+func (c *Client) do(ctx context.Context, method string, u *url.URL, header http.Header) (*Page, error) {
+	trial, ok := c.breaker.allow()
+	if !ok {
+		c.metrics.Fetches.With("result", FetchResultOpen).Add(1)
+		return nil, ErrCircuitOpen
+	}
+
+	if err := c.limiter.acquire(ctx); err != nil {
+		c.breaker.done(trial, err)
+		if err == ErrOverloaded {
+			c.metrics.Fetches.With("result", FetchResultRejected).Add(1)
+		} else {
+			c.metrics.Fetches.With("result", FetchResultCancelled).Add(1)
+		}
+		return nil, err
+	}
+
+	page, err := c.fetch(ctx, method, u, header)
+	c.breaker.done(trial, err)
+	if err != nil {
+		c.limiter.release()
+		return nil, err
+	}
+	var (
+		body = page.Body
+		once sync.Once
+	)
+	page.Body = readCloser{body, closerFunc(func() error {
+		once.Do(c.limiter.release)
+		return body.Close()
+	})}
+	return page, nil
+}
+
+func (c *Client) fetch(ctx context.Context, method string, u *url.URL, header http.Header) (*Page, error) {
+	var (
+		page     *Page
+		attempts int
+		start    = time.Now()
+		bo       = &retryAfterBackOff{BackOff: c.retry.backOff(c.timeout)}
+	)
+	opFunc := func() error {
+		req, err := http.NewRequest(method, fmt.Sprintf("%s/%s%s", c.server, c.token, cleanPath(u)), nil)
+		if err != nil {
+			return backoff.Permanent(&UpstreamError{Err: err})
+		}
+		req = req.WithContext(ctx)
+
+		req.Header = c.requestHeaders.filter(header)
+		ips := []string{c.ip}
+		if xff := header.Get("X-Forwarded-For"); xff != "" {
+			ips = append(ips, xff)
+		}
+		req.Header.Set("X-Forwarded-For", strings.Join(ips, ", "))
+		// the transport negotiates compression itself and decodes the body, so snapshots are
+		// cached, inspected and limited uncompressed and can be served to any client
+		req.Header.Del("Accept-Encoding")
+
+		if c.unconditionalFetch {
+			req.Header.Del("If-Modified-Since")
+			req.Header.Del("If-None-Match")
+		}
+
+		attempts++
+		resp, err := c.http.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return backoff.Permanent(ctx.Err())
+			}
+			if !c.retry.retryError(err) || c.lastAttempt(attempts) {
+				return backoff.Permanent(&UpstreamError{Err: err})
+			}
+			return &UpstreamError{Err: err}
+		}
+
+		if c.relayStatus[resp.StatusCode] {
+			page = &Page{
+				StatusCode:    resp.StatusCode,
+				Header:        resp.Header,
+				Body:          resp.Body,
+				ContentLength: -1,
+			}
+			if err := c.checkSnapshot(resp); err != nil {
+				resp.Body.Close()
+				page = nil
+				return backoff.Permanent(&UpstreamError{StatusCode: resp.StatusCode, Err: err})
+			}
+			if method == http.MethodHead {
+				page.ContentLength = resp.ContentLength
+				return nil
+			}
+			if !c.bufferResponses && c.maxSnapshotSize <= 0 {
+				return nil
+			}
+			if err := c.bufferBody(page); err != nil {
+				page = nil
+				if ctx.Err() != nil {
+					return backoff.Permanent(ctx.Err())
+				}
+				var snapshotErr *SnapshotError
+				if errors.As(err, &snapshotErr) {
+					return backoff.Permanent(&UpstreamError{StatusCode: resp.StatusCode, Err: err})
+				}
+				// a partial body is retried like a failed request
+				upstreamErr := &UpstreamError{StatusCode: resp.StatusCode, Err: err}
+				if !c.retry.retryError(err) || c.lastAttempt(attempts) {
+					return backoff.Permanent(upstreamErr)
+				}
+				return upstreamErr
+			}
+			return nil
+		}
+		resp.Body.Close()
+		statusErr := statusError(resp.StatusCode)
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			statusErr.RetryAfter, _ = retryAfter(resp.Header, time.Now())
+		}
+
+		// conditionally terminate retry loop depending on the status code
+		if !c.retry.retryStatus(resp.StatusCode, c.retryUnavailable) || c.lastAttempt(attempts) {
+			return backoff.Permanent(statusErr)
+		}
+		// give up if the requested delay exceeds the timeout, or the longest backoff without one
+		maxDelay := c.retry.MaxInterval
+		if c.timeout > 0 {
+			maxDelay = c.timeout - time.Since(start)
+		}
+		if statusErr.RetryAfter > maxDelay {
+			return backoff.Permanent(statusErr)
+		}
+
+		// retry, but not before the requested delay
+		bo.retryAfter = statusErr.RetryAfter
+		return statusErr
+	}
+
+	err := backoff.Retry(opFunc, backoff.WithContext(bo, ctx))
+	if ctx.Err() != nil {
+		if page != nil {
+			page.Body.Close()
+		}
+		c.metrics.Fetches.With("result", FetchResultCancelled).Add(1)
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		var snapshotErr *SnapshotError
+		if errors.As(err, &snapshotErr) {
+			c.metrics.Fetches.With("result", FetchResultInvalid).Add(1)
+		} else {
+			c.metrics.Fetches.With("result", FetchResultError).Add(1)
+		}
+		if upstreamErr, ok := err.(*UpstreamError); ok {
+			upstreamErr.Attempts = attempts
+			upstreamErr.Elapsed = time.Since(start)
+		}
+		return nil, err
+	}
+	c.metrics.Fetches.With("result", FetchResultSuccess).Add(1)
+	return page, nil
+}
+
+// lastAttempt reports whether the RetryPolicy allows no further attempts
+func (c *Client) lastAttempt(attempts int) bool {
+	return c.retry.MaxAttempts > 0 && attempts >= c.retry.MaxAttempts
+}
@@ -0,0 +1,197 @@
+package seo4ajax
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFetch(t *testing.T) {
+	Convey("Fetch returns the page", t, func() {
+		var upstream *http.Request
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upstream = r
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html></html>"))
+		}))
+		defer ts.Close()
+
+		seo4ajaxClient, err := New(Config{Token: "123", Server: ts.URL})
+		So(err, ShouldBeNil)
+
+		header := http.Header{"X-Forwarded-For": {"10.0.0.1"}}
+		page, err := seo4ajaxClient.Fetch(context.Background(), &url.URL{Path: "path", RawQuery: "a=b"}, header)
+		So(err, ShouldBeNil)
+		defer page.Body.Close()
+		So(page.StatusCode, ShouldEqual, http.StatusOK)
+		So(page.Header.Get("Content-Type"), ShouldEqual, "text/html")
+		body, err := ioutil.ReadAll(page.Body)
+		So(err, ShouldBeNil)
+		So(string(body), ShouldEqual, "<html></html>")
+		So(header, ShouldResemble, http.Header{"X-Forwarded-For": {"10.0.0.1"}})
+
+		So(upstream.URL.Path, ShouldEqual, "/123/path")
+		So(upstream.URL.RawQuery, ShouldEqual, "a=b")
+		So(upstream.Header.Get("X-Forwarded-For"), ShouldEqual, "127.0.0.1, 10.0.0.1")
+	})
+
+	Convey("Fetch returns typed errors", t, func() {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.NotFound(w, r)
+		}))
+		defer ts.Close()
+
+		seo4ajaxClient, err := New(Config{Token: "123", Server: ts.URL, RelayStatus: []int{http.StatusOK}})
+		So(err, ShouldBeNil)
+
+		page, err := seo4ajaxClient.Fetch(context.Background(), &url.URL{Path: "/"}, nil)
+		So(page, ShouldBeNil)
+		var upstreamErr *UpstreamError
+		So(errors.As(err, &upstreamErr), ShouldBeTrue)
+		So(upstreamErr.StatusCode, ShouldEqual, http.StatusNotFound)
+		So(upstreamErr.Attempts, ShouldEqual, 1)
+		So(errors.Is(err, ErrPageNotFound), ShouldBeTrue)
+	})
+
+	Convey("upstream errors wrap the sentinels and are passed to OnError", t, func() {
+		status := http.StatusServiceUnavailable
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "failed", status)
+		}))
+		defer ts.Close()
+
+		var hookErr error
+		seo4ajaxClient, err := New(Config{
+			Token:   "123",
+			Server:  ts.URL,
+			Timeout: 300 * time.Millisecond,
+			OnError: func(r *http.Request, err error) {
+				hookErr = err
+			},
+		})
+		So(err, ShouldBeNil)
+
+		req, err := http.NewRequest("GET", "http://"+appAdress+"/?_escaped_fragment_=", nil)
+		So(err, ShouldBeNil)
+
+		Convey("cache miss", func() {
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusServiceUnavailable)
+			So(errors.Is(hookErr, ErrCacheMiss), ShouldBeTrue)
+		})
+
+		Convey("unknown status after retries", func() {
+			status = http.StatusBadGateway
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, req)
+			So(errors.Is(hookErr, ErrUnknownStatus), ShouldBeTrue)
+
+			var upstreamErr *UpstreamError
+			So(errors.As(hookErr, &upstreamErr), ShouldBeTrue)
+			So(upstreamErr.StatusCode, ShouldEqual, http.StatusBadGateway)
+			So(upstreamErr.Attempts, ShouldBeGreaterThan, 1)
+			So(upstreamErr.Elapsed, ShouldBeGreaterThan, 0)
+			So(upstreamErr.Error(), ShouldStartWith, "seo4ajax: status 502 after ")
+		})
+	})
+
+	Convey("cancelling the context stops the retry loop", t, func() {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "internal", http.StatusInternalServerError)
+		}))
+		defer ts.Close()
+
+		seo4ajaxClient, err := New(Config{Token: "123", Server: ts.URL, Timeout: 30 * time.Second})
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(200*time.Millisecond, cancel)
+		start := time.Now()
+		page, err := seo4ajaxClient.Fetch(ctx, &url.URL{Path: "/"}, nil)
+		So(page, ShouldBeNil)
+		So(err, ShouldEqual, context.Canceled)
+		So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+	})
+
+	Convey("requests cancelled by the crawler are not retried and counted as cancelled", t, func() {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "internal", http.StatusInternalServerError)
+		}))
+		defer ts.Close()
+
+		fetches := &testCounter{}
+		seo4ajaxClient, err := New(Config{
+			Token:   "123",
+			Server:  ts.URL,
+			Timeout: 30 * time.Second,
+			Metrics: Metrics{Fetches: fetches},
+		})
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(200*time.Millisecond, cancel)
+		req, err := http.NewRequest("GET", "http://"+appAdress+"/?_escaped_fragment_=", nil)
+		So(err, ShouldBeNil)
+		req = req.WithContext(ctx)
+
+		recorder := httptest.NewRecorder()
+		start := time.Now()
+		seo4ajaxClient.ServeHTTP(recorder, req)
+		So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+		So(fetches.values, ShouldResemble, map[string]float64{"result=cancelled": 1})
+
+		seo4ajaxClient.ServeHTTP(httptest.NewRecorder(), req)
+		So(fetches.value("result=cancelled"), ShouldEqual, 2)
+	})
+}
+
+// testCounter is a metrics.Counter recording values by label values
+type testCounter struct {
+	mu     sync.Mutex
+	labels []string
+	values map[string]float64
+	parent *testCounter
+}
+
+func (c *testCounter) With(labelValues ...string) metrics.Counter {
+	root := c
+	if c.parent != nil {
+		root = c.parent
+	}
+	return &testCounter{labels: append(append([]string{}, c.labels...), labelValues...), parent: root}
+}
+
+func (c *testCounter) Add(delta float64) {
+	root := c
+	if c.parent != nil {
+		root = c.parent
+	}
+	var key []string
+	for i := 0; i+1 < len(c.labels); i += 2 {
+		key = append(key, c.labels[i]+"="+c.labels[i+1])
+	}
+
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if root.values == nil {
+		root.values = map[string]float64{}
+	}
+	root.values[strings.Join(key, ",")] += delta
+}
+
+func (c *testCounter) value(key string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
@@ -1,6 +1,6 @@
 module github.com/justwatchcom/go-seo4ajax
 
-go 1.12
+go 1.13
 
 require (
 	github.com/cenkalti/backoff v2.2.1+incompatible
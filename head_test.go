@@ -0,0 +1,75 @@
+package seo4ajax
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHeadRequests(t *testing.T) {
+	Convey("HEAD requests", t, func() {
+		var (
+			mu      sync.Mutex
+			methods []string
+		)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			methods = append(methods, r.Method)
+			mu.Unlock()
+			w.Header().Set("Content-Length", "8")
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("snapshot"))
+		}))
+		defer ts.Close()
+
+		cfg := Config{Token: "123", Server: ts.URL}
+		serve := func(seo4ajaxClient *Client, method string) *httptest.ResponseRecorder {
+			req, err := http.NewRequest(method, "http://"+appAdress+"/page?_escaped_fragment_=", nil)
+			So(err, ShouldBeNil)
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		Convey("are sent upstream as HEAD", func() {
+			seo4ajaxClient, err := New(cfg)
+			So(err, ShouldBeNil)
+			recorder := serve(seo4ajaxClient, "HEAD")
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(recorder.Header().Get("Content-Length"), ShouldEqual, "8")
+			So(recorder.Header().Get("Content-Type"), ShouldEqual, "text/html")
+			So(recorder.Body.Len(), ShouldEqual, 0)
+			So(methods, ShouldResemble, []string{"HEAD"})
+		})
+
+		Convey("are served from the cache", func() {
+			cfg.Cache = NewMemoryCache(10, 0)
+			seo4ajaxClient, err := New(cfg)
+			So(err, ShouldBeNil)
+
+			recorder := serve(seo4ajaxClient, "HEAD")
+			So(recorder.Header().Get("X-Cache"), ShouldEqual, CacheMiss)
+			So(seo4ajaxClient.cache.(*MemoryCache).Len(), ShouldEqual, 0)
+
+			serve(seo4ajaxClient, "GET")
+			recorder = serve(seo4ajaxClient, "HEAD")
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(recorder.Header().Get("X-Cache"), ShouldEqual, CacheHit)
+			So(recorder.Header().Get("Content-Length"), ShouldEqual, "8")
+			So(recorder.Body.Len(), ShouldEqual, 0)
+			So(methods, ShouldResemble, []string{"HEAD", "GET"})
+		})
+
+		Convey("aren't coalesced with GET requests", func() {
+			cfg.Coalesce = true
+			seo4ajaxClient, err := New(cfg)
+			So(err, ShouldBeNil)
+			So(serve(seo4ajaxClient, "HEAD").Body.Len(), ShouldEqual, 0)
+			So(serve(seo4ajaxClient, "GET").Body.String(), ShouldEqual, "snapshot")
+			So(methods, ShouldResemble, []string{"HEAD", "GET"})
+		})
+	})
+}
@@ -0,0 +1,169 @@
+package seo4ajax
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// DefaultAllowHeaders are the request headers forwarded to seo4ajax by default. Other headers,
+// e.g. internal tracing headers, don't leave the server unless allowed explicitly
+var DefaultAllowHeaders = []string{
+	"User-Agent",
+	"Accept",
+	"Accept-Language",
+	"Content-Type",
+	"X-Forwarded-For",
+	"If-None-Match",
+	"If-Modified-Since",
+}
+
+// DefaultDenyHeaders are the request headers not forwarded to seo4ajax by default
+var DefaultDenyHeaders = []string{"Cookie", "Authorization", "Proxy-Authorization"}
+
+// hopHeaders are the hop-by-hop headers defined in RFC 7230, section 6.1, which are never forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RequestHeaderPolicy selects the request headers forwarded to seo4ajax.
+// Hop-by-hop headers are never forwarded.
+type RequestHeaderPolicy struct {
+	// Allow lists the forwarded headers, defaults to DefaultAllowHeaders.
+	// Set it to an empty slice to forward all headers but the denied ones
+	Allow []string
+	// Deny lists headers which are never forwarded, defaults to DefaultDenyHeaders.
+	// Set it to an empty slice to forward Cookie and Authorization headers
+	Deny []string
+}
+
+func (p RequestHeaderPolicy) compile() headerFilter {
+	allow := p.Allow
+	if allow == nil {
+		allow = DefaultAllowHeaders
+	}
+	deny := p.Deny
+	if deny == nil {
+		deny = DefaultDenyHeaders
+	}
+	return newHeaderFilter(allow, deny)
+}
+
+// DefaultDropHeaders are the seo4ajax response headers not relayed by default
+var DefaultDropHeaders = []string{"Set-Cookie"}
+
+// HeaderOverride sets headers on responses for matching paths
+type HeaderOverride struct {
+	// Path selects the request paths the override applies to, all paths if nil
+	Path *regexp.Regexp
+	// Header replaces the upstream headers of the same name
+	Header http.Header
+}
+
+// ResponseHeaderPolicy selects and rewrites the seo4ajax response headers relayed to the client.
+// Hop-by-hop headers are never relayed. Overrides and Rewrite are applied in this order after
+// filtering, before the header is written.
+type ResponseHeaderPolicy struct {
+	// Allow lists the relayed headers. All headers are relayed if empty
+	Allow []string
+	// Drop lists headers which are never relayed, defaults to DefaultDropHeaders.
+	// Set it to an empty slice to relay Set-Cookie headers
+	Drop []string
+	// Overrides set headers per path, e.g. a Cache-Control matching the CDN policy
+	Overrides []HeaderOverride
+	// Rewrite is called with the request and the response header, e.g. to add X-Robots-Tag
+	Rewrite func(r *http.Request, h http.Header)
+}
+
+type responseHeaderPolicy struct {
+	filter    headerFilter
+	overrides []HeaderOverride
+	rewrite   func(r *http.Request, h http.Header)
+}
+
+func (p ResponseHeaderPolicy) compile() responseHeaderPolicy {
+	drop := p.Drop
+	if drop == nil {
+		drop = DefaultDropHeaders
+	}
+	return responseHeaderPolicy{
+		filter:    newHeaderFilter(p.Allow, drop),
+		overrides: p.Overrides,
+		rewrite:   p.Rewrite,
+	}
+}
+
+// apply copies the relayed headers of upstream into dst and applies overrides and rewrites
+func (p responseHeaderPolicy) apply(r *http.Request, dst, upstream http.Header) {
+	for k, v := range p.filter.filter(upstream) {
+		dst[k] = v
+	}
+	for _, o := range p.overrides {
+		if o.Path != nil && !o.Path.MatchString(r.URL.Path) {
+			continue
+		}
+		for k, v := range o.Header {
+			dst[http.CanonicalHeaderKey(k)] = append([]string(nil), v...)
+		}
+	}
+	if p.rewrite != nil {
+		p.rewrite(r, dst)
+	}
+}
+
+type headerFilter struct {
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+func newHeaderFilter(allow, deny []string) headerFilter {
+	return headerFilter{
+		allow: headerSet(allow),
+		deny:  headerSet(append(append([]string{}, deny...), hopHeaders...)),
+	}
+}
+
+// filter returns a copy of h without denied and hop-by-hop headers, restricted to the allowed
+// headers if any
+func (p headerFilter) filter(h http.Header) http.Header {
+	connection := headerSet(connectionTokens(h))
+
+	out := make(http.Header, len(h))
+	for k, v := range h {
+		k = http.CanonicalHeaderKey(k)
+		if p.deny[k] || connection[k] || (len(p.allow) > 0 && !p.allow[k]) {
+			continue
+		}
+		out[k] = append([]string(nil), v...)
+	}
+	return out
+}
+
+// connectionTokens returns the headers listed in the Connection header, which are hop-by-hop as well
+func connectionTokens(h http.Header) []string {
+	var tokens []string
+	for _, v := range h["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+func headerSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[http.CanonicalHeaderKey(name)] = true
+	}
+	return set
+}
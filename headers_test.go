@@ -0,0 +1,192 @@
+package seo4ajax
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRequestHeaderPolicy(t *testing.T) {
+	Convey("request headers forwarded to seo4ajax", t, func() {
+		var upstream http.Header
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upstream = r.Header
+		}))
+		defer ts.Close()
+
+		req, err := http.NewRequest("GET", "http://"+appAdress+"/?_escaped_fragment_=", nil)
+		So(err, ShouldBeNil)
+		req.Header.Set("User-Agent", "Googlebot")
+		req.Header.Set("Accept-Language", "de")
+		req.Header.Set("Cookie", "session=secret")
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("X-Trace-Id", "abc")
+		req.Header.Set("Connection", "keep-alive, X-Hop")
+		req.Header.Set("X-Hop", "1")
+		req.Header.Set("Upgrade", "h2c")
+		orig := req.Header.Clone()
+
+		Convey("default policy forwards the allowed headers only", func() {
+			seo4ajaxClient, err := New(Config{Token: "123", Server: ts.URL})
+			So(err, ShouldBeNil)
+			seo4ajaxClient.ServeHTTP(httptest.NewRecorder(), req)
+
+			So(upstream.Get("User-Agent"), ShouldEqual, "Googlebot")
+			So(upstream.Get("Accept-Language"), ShouldEqual, "de")
+			So(upstream.Get("X-Forwarded-For"), ShouldEqual, "127.0.0.1")
+			for _, h := range []string{"Cookie", "Authorization", "X-Trace-Id", "X-Hop", "Upgrade"} {
+				So(upstream.Get(h), ShouldBeEmpty)
+			}
+			So(req.Header, ShouldResemble, orig)
+		})
+
+		Convey("an empty allow list forwards all but credentials and hop-by-hop headers", func() {
+			seo4ajaxClient, err := New(Config{
+				Token:          "123",
+				Server:         ts.URL,
+				RequestHeaders: RequestHeaderPolicy{Allow: []string{}},
+			})
+			So(err, ShouldBeNil)
+			seo4ajaxClient.ServeHTTP(httptest.NewRecorder(), req)
+
+			So(upstream.Get("User-Agent"), ShouldEqual, "Googlebot")
+			So(upstream.Get("X-Trace-Id"), ShouldEqual, "abc")
+			for _, h := range []string{"Cookie", "Authorization", "X-Hop", "Upgrade"} {
+				So(upstream.Get(h), ShouldBeEmpty)
+			}
+		})
+
+		Convey("allow and deny lists", func() {
+			seo4ajaxClient, err := New(Config{
+				Token:  "123",
+				Server: ts.URL,
+				RequestHeaders: RequestHeaderPolicy{
+					Allow: []string{"user-agent", "accept-language", "cookie", "x-hop"},
+					Deny:  []string{"Accept-Language"},
+				},
+			})
+			So(err, ShouldBeNil)
+			seo4ajaxClient.ServeHTTP(httptest.NewRecorder(), req)
+
+			So(upstream.Get("User-Agent"), ShouldEqual, "Googlebot")
+			So(upstream.Get("Cookie"), ShouldEqual, "session=secret")
+			So(upstream.Get("X-Forwarded-For"), ShouldEqual, "127.0.0.1")
+			for _, h := range []string{"Accept-Language", "Authorization", "X-Trace-Id", "X-Hop"} {
+				So(upstream.Get(h), ShouldBeEmpty)
+			}
+		})
+	})
+}
+
+func TestResponseHeaderPolicy(t *testing.T) {
+	Convey("response headers relayed from seo4ajax", t, func() {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Set-Cookie", "s4a=1")
+			w.Header().Set("Server", "s4a")
+			switch r.URL.Path {
+			case "/123/titles/moved":
+				http.Redirect(w, r, "/titles/new", http.StatusMovedPermanently)
+			case "/123/titles/meta":
+				w.Write([]byte(`<html><head><meta name="prerender-header" content="Set-Cookie: meta=1">` +
+					`<meta name="prerender-header" content="Cache-Control: no-cache"></head></html>`))
+			default:
+				w.Write([]byte("<html></html>"))
+			}
+		}))
+		defer ts.Close()
+
+		newReq := func(path string) *http.Request {
+			req, err := http.NewRequest("GET", "http://"+appAdress+path+"?_escaped_fragment_=", nil)
+			So(err, ShouldBeNil)
+			return req
+		}
+
+		Convey("default policy drops Set-Cookie", func() {
+			seo4ajaxClient, err := New(Config{Token: "123", Server: ts.URL})
+			So(err, ShouldBeNil)
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, newReq("/"))
+
+			So(recorder.Header().Get("Content-Type"), ShouldEqual, "text/html")
+			So(recorder.Header().Get("Cache-Control"), ShouldEqual, "max-age=60")
+			So(recorder.Header().Get("Server"), ShouldEqual, "s4a")
+			So(recorder.Header().Get("Set-Cookie"), ShouldBeEmpty)
+		})
+
+		Convey("drop lists, overrides and rewrites", func() {
+			seo4ajaxClient, err := New(Config{
+				Token:  "123",
+				Server: ts.URL,
+				ResponseHeaders: ResponseHeaderPolicy{
+					Drop: []string{"Server", "Set-Cookie"},
+					Overrides: []HeaderOverride{
+						{Path: regexp.MustCompile(`^/titles/`), Header: http.Header{"Cache-Control": {"public, max-age=3600"}}},
+					},
+					Rewrite: func(r *http.Request, h http.Header) {
+						h.Set("X-Robots-Tag", "noarchive")
+					},
+				},
+			})
+			So(err, ShouldBeNil)
+
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, newReq("/titles/1"))
+			So(recorder.Header().Get("Cache-Control"), ShouldEqual, "public, max-age=3600")
+			So(recorder.Header().Get("X-Robots-Tag"), ShouldEqual, "noarchive")
+			So(recorder.Header().Get("Server"), ShouldBeEmpty)
+			So(recorder.Header().Get("Set-Cookie"), ShouldBeEmpty)
+
+			recorder = httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, newReq("/other"))
+			So(recorder.Header().Get("Cache-Control"), ShouldEqual, "max-age=60")
+
+			recorder = httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, newReq("/titles/moved"))
+			So(recorder.Code, ShouldEqual, http.StatusMovedPermanently)
+			So(recorder.Header().Get("Location"), ShouldEqual, "/titles/new")
+			So(recorder.Header().Get("Cache-Control"), ShouldEqual, "public, max-age=3600")
+			So(recorder.Header().Get("X-Robots-Tag"), ShouldEqual, "noarchive")
+			So(recorder.Header().Get("Server"), ShouldBeEmpty)
+		})
+
+		Convey("snapshot meta headers are subject to the policy", func() {
+			seo4ajaxClient, err := New(Config{
+				Token:       "123",
+				Server:      ts.URL,
+				InspectMeta: true,
+				ResponseHeaders: ResponseHeaderPolicy{
+					Overrides: []HeaderOverride{
+						{Header: http.Header{"Cache-Control": {"public, max-age=3600"}}},
+					},
+				},
+			})
+			So(err, ShouldBeNil)
+
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, newReq("/titles/meta"))
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(recorder.Header().Get("Set-Cookie"), ShouldBeEmpty)
+			So(recorder.Header().Get("Cache-Control"), ShouldEqual, "public, max-age=3600")
+		})
+
+		Convey("allow list", func() {
+			seo4ajaxClient, err := New(Config{
+				Token:           "123",
+				Server:          ts.URL,
+				ResponseHeaders: ResponseHeaderPolicy{Allow: []string{"Content-Type"}},
+			})
+			So(err, ShouldBeNil)
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, newReq("/"))
+
+			So(recorder.Header().Get("Content-Type"), ShouldEqual, "text/html")
+			So(recorder.Header().Get("Cache-Control"), ShouldBeEmpty)
+			So(recorder.Header().Get("Server"), ShouldBeEmpty)
+		})
+	})
+}
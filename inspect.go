@@ -0,0 +1,62 @@
+package seo4ajax
+
+import (
+	"html"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxInspectSize is the maximum number of bytes of a snapshot searched for meta tags
+const maxInspectSize = 64 << 10
+
+var (
+	regexMetaTag   = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	regexAttribute = regexp.MustCompile(`(?is)([a-z-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+	regexHeadEnd   = regexp.MustCompile(`(?i)</head\s*>|<body[\s>]`)
+)
+
+// metaDirectives are the response modifications requested by the snapshot through
+// <meta name="prerender-status-code"> and <meta name="prerender-header"> tags
+type metaDirectives struct {
+	status int
+	header http.Header
+}
+
+// inspectMeta parses the meta tags in the head of the given snapshot prefix
+func inspectMeta(snapshot []byte) metaDirectives {
+	if loc := regexHeadEnd.FindIndex(snapshot); loc != nil {
+		snapshot = snapshot[:loc[0]]
+	}
+
+	d := metaDirectives{header: http.Header{}}
+	for _, tag := range regexMetaTag.FindAll(snapshot, -1) {
+		attrs := map[string]string{}
+		for _, m := range regexAttribute.FindAllSubmatch(tag, -1) {
+			value := m[2]
+			if value == nil {
+				value = m[3]
+			}
+			if value == nil {
+				value = m[4]
+			}
+			attrs[strings.ToLower(string(m[1]))] = html.UnescapeString(string(value))
+		}
+
+		content := strings.TrimSpace(attrs["content"])
+		switch strings.ToLower(attrs["name"]) {
+		case "prerender-status-code":
+			if status, err := strconv.Atoi(content); err == nil && status >= 100 && status <= 599 {
+				d.status = status
+			}
+		case "prerender-header":
+			i := strings.IndexByte(content, ':')
+			if i <= 0 {
+				continue
+			}
+			d.header.Add(strings.TrimSpace(content[:i]), strings.TrimSpace(content[i+1:]))
+		}
+	}
+	return d
+}
@@ -0,0 +1,88 @@
+package seo4ajax
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestInspectMeta(t *testing.T) {
+	Convey("meta tags are parsed from the head", t, func() {
+		d := inspectMeta([]byte(`<!DOCTYPE html><html><head>
+<meta charset="utf-8">
+<META NAME="prerender-status-code" CONTENT="301">
+<meta content='Location: https://example.com/new?a=1&amp;b=2' name='prerender-header'>
+<meta name="prerender-header" content="X-Robots-Tag: noindex">
+<meta name="prerender-header" content="invalid">
+</head><body>
+<meta name="prerender-status-code" content="500">
+</body></html>`))
+		So(d.status, ShouldEqual, 301)
+		So(d.header, ShouldResemble, http.Header{
+			"Location":     {"https://example.com/new?a=1&b=2"},
+			"X-Robots-Tag": {"noindex"},
+		})
+
+		d = inspectMeta([]byte(`<html><head><meta name="prerender-status-code" content="abc"></head></html>`))
+		So(d.status, ShouldEqual, 0)
+	})
+
+	Convey("snapshot meta tags rewrite the response", t, func() {
+		var (
+			snapshot string
+			method   atomic.Value
+		)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			method.Store(r.Method)
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(snapshot))
+		}))
+		defer ts.Close()
+
+		newClient := func(inspect bool) *Client {
+			seo4ajaxClient, err := New(Config{Token: "123", Server: ts.URL, InspectMeta: inspect})
+			So(err, ShouldBeNil)
+			return seo4ajaxClient
+		}
+		req, err := http.NewRequest("GET", "http://"+appAdress+"/?_escaped_fragment_=", nil)
+		So(err, ShouldBeNil)
+
+		Convey("soft 404", func() {
+			snapshot = `<html><head><meta name="prerender-status-code" content="404"></head><body>` + strings.Repeat("x", 2*maxInspectSize) + `</body></html>`
+			recorder := httptest.NewRecorder()
+			newClient(true).ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusNotFound)
+			So(recorder.Header().Get("Content-Type"), ShouldEqual, "text/html")
+			So(recorder.Body.String(), ShouldEqual, snapshot)
+		})
+
+		Convey("soft 404 of a HEAD request", func() {
+			snapshot = `<html><head><meta name="prerender-status-code" content="404"></head></html>`
+			req.Method = http.MethodHead
+			recorder := httptest.NewRecorder()
+			newClient(true).ServeHTTP(recorder, req)
+			So(method.Load(), ShouldEqual, http.MethodGet)
+			So(recorder.Code, ShouldEqual, http.StatusNotFound)
+			So(recorder.Body.Len(), ShouldEqual, 0)
+		})
+
+		Convey("redirect", func() {
+			snapshot = `<html><head><meta name="prerender-status-code" content="301"><meta name="prerender-header" content="Location: http://example.com/new"></head></html>`
+			recorder := httptest.NewRecorder()
+			newClient(true).ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusMovedPermanently)
+			So(recorder.Header().Get("Location"), ShouldEqual, "http://example.com/new")
+		})
+
+		Convey("disabled by default", func() {
+			snapshot = `<html><head><meta name="prerender-status-code" content="404"></head></html>`
+			recorder := httptest.NewRecorder()
+			newClient(false).ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+		})
+	})
+}
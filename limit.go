@@ -0,0 +1,101 @@
+package seo4ajax
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ErrOverloaded is returned by Fetch if no fetch slot became available, see MaxConcurrentFetches
+var ErrOverloaded = errors.New("too many concurrent seo4ajax fetches")
+
+// OverloadPolicy selects the response to requests rejected because of MaxConcurrentFetches
+type OverloadPolicy int
+
+const (
+	// OverloadUnavailable responds with 503 and a Retry-After header
+	OverloadUnavailable OverloadPolicy = iota
+	// OverloadNext passes the request to the Next handler, responding like OverloadUnavailable if there is none
+	OverloadNext
+	// OverloadStale serves the cached snapshot regardless of its age, responding like
+	// OverloadUnavailable if there is none
+	OverloadStale
+)
+
+// limiter bounds the number of concurrent fetches and of the requests waiting for one
+type limiter struct {
+	slots     chan struct{}
+	queued    int32
+	maxQueued int32
+	timeout   time.Duration
+}
+
+func newLimiter(maxConcurrent, maxQueued int, timeout time.Duration) *limiter {
+	if maxConcurrent <= 0 {
+		return nil
+	}
+	if maxQueued < 0 {
+		maxQueued = 0
+	}
+	return &limiter{
+		slots:     make(chan struct{}, maxConcurrent),
+		maxQueued: int32(maxQueued),
+		timeout:   timeout,
+	}
+}
+
+// acquire waits for a free slot. It returns ErrOverloaded if the queue is full or the queue
+// timeout passed, and the context error if ctx is done first
+func (l *limiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if atomic.AddInt32(&l.queued, 1) > l.maxQueued {
+		atomic.AddInt32(&l.queued, -1)
+		return ErrOverloaded
+	}
+	defer atomic.AddInt32(&l.queued, -1)
+
+	t := time.NewTimer(l.timeout)
+	defer t.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-t.C:
+		return ErrOverloaded
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *limiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
+
+// overloaded responds to a request rejected because of MaxConcurrentFetches
+func (c *Client) overloaded(w http.ResponseWriter, r *http.Request, cached *CacheEntry) {
+	c.log.Log("level", "warn", "msg", "Upstream fetch rejected", "err", ErrOverloaded, "path", r.URL.Path)
+	switch {
+	case c.overloadPolicy == OverloadNext && c.next != nil:
+		c.next.ServeHTTP(w, r)
+		return
+	case c.overloadPolicy == OverloadStale && cached != nil:
+		c.writePage(w, r, cachedPage(cached), CacheStale)
+		return
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(c.overloadRetryAfter.Seconds()))))
+	http.Error(w, "Upstream overloaded", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,146 @@
+package seo4ajax
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConcurrencyLimit(t *testing.T) {
+	Convey("fetches beyond MaxConcurrentFetches", t, func() {
+		release := make(chan struct{})
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/123/slow" {
+				<-release
+			}
+			w.Write([]byte("snapshot"))
+		}))
+		defer ts.Close()
+
+		newReq := func(path string) *http.Request {
+			req, err := http.NewRequest("GET", "http://"+appAdress+path+"?_escaped_fragment_=", nil)
+			So(err, ShouldBeNil)
+			return req
+		}
+		occupy := func(c *Client) chan struct{} {
+			done := make(chan struct{})
+			req := newReq("/slow")
+			go func() {
+				defer close(done)
+				c.ServeHTTP(httptest.NewRecorder(), req)
+			}()
+			time.Sleep(100 * time.Millisecond)
+			return done
+		}
+
+		cfg := Config{
+			Token:                "123",
+			Server:               ts.URL,
+			MaxConcurrentFetches: 1,
+			MaxQueuedFetches:     -1,
+			Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			}),
+		}
+
+		Convey("are rejected with 503 and Retry-After", func() {
+			fetches := &testCounter{}
+			cfg.Metrics = Metrics{Fetches: fetches}
+			seo4ajaxClient, err := New(cfg)
+			So(err, ShouldBeNil)
+			done := occupy(seo4ajaxClient)
+
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, newReq("/fast"))
+			So(recorder.Code, ShouldEqual, http.StatusServiceUnavailable)
+			So(recorder.Header().Get("Retry-After"), ShouldEqual, "5")
+			So(fetches.value("result=rejected"), ShouldEqual, 1)
+
+			close(release)
+			<-done
+			recorder = httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, newReq("/fast"))
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("wait in the queue until a slot is free by default", func() {
+			cfg.MaxQueuedFetches = 0
+			seo4ajaxClient, err := New(cfg)
+			So(err, ShouldBeNil)
+			done := occupy(seo4ajaxClient)
+
+			time.AfterFunc(100*time.Millisecond, func() { close(release) })
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, newReq("/fast"))
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			<-done
+		})
+
+		Convey("give up after the queue timeout", func() {
+			cfg.MaxQueuedFetches = 1
+			cfg.QueueTimeout = 50 * time.Millisecond
+			seo4ajaxClient, err := New(cfg)
+			So(err, ShouldBeNil)
+			done := occupy(seo4ajaxClient)
+
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, newReq("/fast"))
+			So(recorder.Code, ShouldEqual, http.StatusServiceUnavailable)
+			close(release)
+			<-done
+		})
+
+		Convey("round Retry-After up to whole seconds", func() {
+			cfg.OverloadRetryAfter = 500 * time.Millisecond
+			seo4ajaxClient, err := New(cfg)
+			So(err, ShouldBeNil)
+			done := occupy(seo4ajaxClient)
+
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, newReq("/fast"))
+			So(recorder.Header().Get("Retry-After"), ShouldEqual, "1")
+			close(release)
+			<-done
+		})
+
+		Convey("fall back to next", func() {
+			cfg.OverloadPolicy = OverloadNext
+			seo4ajaxClient, err := New(cfg)
+			So(err, ShouldBeNil)
+			done := occupy(seo4ajaxClient)
+
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, newReq("/fast"))
+			So(recorder.Code, ShouldEqual, http.StatusTeapot)
+			close(release)
+			<-done
+		})
+
+		Convey("serve stale snapshots", func() {
+			cache := NewMemoryCache(10, 0)
+			cfg.Cache = cache
+			cfg.OverloadPolicy = OverloadStale
+			seo4ajaxClient, err := New(cfg)
+			So(err, ShouldBeNil)
+			req := newReq("/fast")
+			cache.Set(seo4ajaxClient.cacheKey(req), &CacheEntry{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       []byte("old"),
+				Expires:    time.Now().Add(-24 * time.Hour),
+			})
+			done := occupy(seo4ajaxClient)
+
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(recorder.Header().Get("X-Cache"), ShouldEqual, CacheStale)
+			So(recorder.Body.String(), ShouldEqual, "old")
+			close(release)
+			<-done
+		})
+	})
+}
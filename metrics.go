@@ -0,0 +1,34 @@
+package seo4ajax
+
+import (
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+)
+
+// Fetch results reported in the "result" label of Metrics.Fetches
+const (
+	FetchResultSuccess   = "success"
+	FetchResultError     = "error"
+	FetchResultInvalid   = "invalid"
+	FetchResultCancelled = "cancelled"
+	FetchResultRejected  = "rejected"
+	FetchResultOpen      = "circuit_open"
+)
+
+// Metrics are the instruments updated by the Client. Instruments left nil are discarded
+type Metrics struct {
+	// Fetches counts finished upstream fetches, labelled by "result"
+	Fetches metrics.Counter
+	// BreakerState is set to the BreakerState of the circuit breaker on every transition
+	BreakerState metrics.Gauge
+}
+
+func (m Metrics) withDefaults() Metrics {
+	if m.Fetches == nil {
+		m.Fetches = discard.NewCounter()
+	}
+	if m.BreakerState == nil {
+		m.BreakerState = discard.NewGauge()
+	}
+	return m
+}
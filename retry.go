@@ -0,0 +1,122 @@
+package seo4ajax
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+// RetryPolicy configures retrying failed fetches within Timeout. The zero value retries all
+// failures but 503 and 404 (see RetryUnavailable) with an exponential backoff from 50ms to 30s
+type RetryPolicy struct {
+	// MaxAttempts limits the number of upstream requests per fetch, no limit if zero
+	MaxAttempts int
+	// InitialInterval is the delay before the first retry, defaults to 50ms
+	InitialInterval time.Duration
+	// MaxInterval caps the delay between retries, defaults to 30s. Without Timeout, fetches asked
+	// to wait longer by a Retry-After header give up instead
+	MaxInterval time.Duration
+	// Multiplier is the factor the delay grows by with each retry, defaults to 1.5
+	Multiplier float64
+	// Jitter randomizes each delay by up to this fraction of it, defaults to 0.5. It's disabled if negative
+	Jitter float64
+	// RetryStatus decides per upstream status code whether it is retried, overriding the default
+	// for the statuses present, e.g. {500: false, 404: true}
+	RetryStatus map[int]bool
+	// NoRetryNetworkErrors stops retrying after connection errors other than timeouts
+	NoRetryNetworkErrors bool
+	// NoRetryTimeouts stops retrying after an attempt timed out, see FetchTimeout
+	NoRetryTimeouts bool
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.InitialInterval <= 0 {
+		p.InitialInterval = 50 * time.Millisecond
+	}
+	if p.MaxInterval <= 0 {
+		p.MaxInterval = 30 * time.Second
+	}
+	if p.Multiplier <= 0 {
+		p.Multiplier = backoff.DefaultMultiplier
+	}
+	switch {
+	case p.Jitter == 0:
+		p.Jitter = backoff.DefaultRandomizationFactor
+	case p.Jitter < 0:
+		p.Jitter = 0
+	}
+	return p
+}
+
+// backOff returns the backoff of a single fetch limited to timeout
+func (p RetryPolicy) backOff(timeout time.Duration) *backoff.ExponentialBackOff {
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = p.InitialInterval
+	bo.MaxInterval = p.MaxInterval
+	bo.Multiplier = p.Multiplier
+	bo.RandomizationFactor = p.Jitter
+	if timeout > 0 {
+		bo.MaxElapsedTime = timeout
+	}
+	bo.Reset()
+	return bo
+}
+
+// retryStatus reports whether a fetch failed with the upstream status code is retried
+func (p RetryPolicy) retryStatus(statusCode int, retryUnavailable bool) bool {
+	if retry, ok := p.RetryStatus[statusCode]; ok {
+		return retry
+	}
+	if statusCode == http.StatusServiceUnavailable || statusCode == http.StatusNotFound {
+		return retryUnavailable
+	}
+	return true
+}
+
+// retryError reports whether a fetch failed with the transport error is retried
+func (p RetryPolicy) retryError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return !p.NoRetryTimeouts
+	}
+	return !p.NoRetryNetworkErrors
+}
+
+// retryAfterBackOff delays the next retry at least until the Retry-After of the last response
+type retryAfterBackOff struct {
+	backoff.BackOff
+	retryAfter time.Duration
+}
+
+func (b *retryAfterBackOff) NextBackOff() time.Duration {
+	next := b.BackOff.NextBackOff()
+	if next != backoff.Stop && next < b.retryAfter {
+		next = b.retryAfter
+	}
+	b.retryAfter = 0
+	return next
+}
+
+// retryAfter parses the Retry-After header, given either in seconds or as http date
+func retryAfter(h http.Header, now time.Time) (time.Duration, bool) {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	var d time.Duration
+	if seconds, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(v); err == nil {
+		d = date.Sub(now)
+	} else {
+		return 0, false
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d, true
+}
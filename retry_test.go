@@ -0,0 +1,198 @@
+package seo4ajax
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	Convey("the retry policy", t, func() {
+		var (
+			status int32 = http.StatusInternalServerError
+			delay  int32
+			hits   int32
+		)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			time.Sleep(time.Duration(atomic.LoadInt32(&delay)) * time.Millisecond)
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+		}))
+		defer ts.Close()
+
+		cfg := Config{
+			Token:   "123",
+			Server:  ts.URL,
+			Timeout: 200 * time.Millisecond,
+			Retry:   RetryPolicy{InitialInterval: time.Millisecond, MaxInterval: time.Millisecond},
+		}
+		fetch := func() (*UpstreamError, bool) {
+			seo4ajaxClient, err := New(cfg)
+			So(err, ShouldBeNil)
+			_, err = seo4ajaxClient.Fetch(context.Background(), &url.URL{Path: "/page"}, nil)
+			var upstreamErr *UpstreamError
+			return upstreamErr, errors.As(err, &upstreamErr)
+		}
+
+		Convey("retries until Timeout by default", func() {
+			upstreamErr, ok := fetch()
+			So(ok, ShouldBeTrue)
+			So(upstreamErr.Attempts, ShouldBeGreaterThan, 3)
+		})
+
+		Convey("limits the attempts", func() {
+			cfg.Retry.MaxAttempts = 3
+			upstreamErr, ok := fetch()
+			So(ok, ShouldBeTrue)
+			So(upstreamErr.Attempts, ShouldEqual, 3)
+			So(atomic.LoadInt32(&hits), ShouldEqual, 3)
+
+			cfg.Retry.MaxAttempts = 1
+			upstreamErr, ok = fetch()
+			So(ok, ShouldBeTrue)
+			So(upstreamErr.Attempts, ShouldEqual, 1)
+		})
+
+		Convey("decides per status", func() {
+			cfg.Retry.RetryStatus = map[int]bool{http.StatusInternalServerError: false, http.StatusServiceUnavailable: true}
+			upstreamErr, ok := fetch()
+			So(ok, ShouldBeTrue)
+			So(upstreamErr.Attempts, ShouldEqual, 1)
+
+			atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+			upstreamErr, ok = fetch()
+			So(ok, ShouldBeTrue)
+			So(upstreamErr.Attempts, ShouldBeGreaterThan, 1)
+			So(upstreamErr.Err, ShouldEqual, ErrCacheMiss)
+		})
+
+		Convey("keeps not retrying 503 by default", func() {
+			atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+			upstreamErr, ok := fetch()
+			So(ok, ShouldBeTrue)
+			So(upstreamErr.Attempts, ShouldEqual, 1)
+		})
+
+		Convey("can skip retrying timeouts", func() {
+			atomic.StoreInt32(&delay, 50)
+			cfg.FetchTimeout = 10 * time.Millisecond
+			cfg.Retry.NoRetryTimeouts = true
+			upstreamErr, ok := fetch()
+			So(ok, ShouldBeTrue)
+			So(upstreamErr.Attempts, ShouldEqual, 1)
+
+			cfg.Retry = RetryPolicy{InitialInterval: time.Millisecond, NoRetryNetworkErrors: true}
+			upstreamErr, ok = fetch()
+			So(ok, ShouldBeTrue)
+			So(upstreamErr.Attempts, ShouldBeGreaterThan, 1)
+		})
+
+		Convey("can skip retrying network errors", func() {
+			cfg.Server = "http://127.0.0.1:1"
+			cfg.Retry.NoRetryNetworkErrors = true
+			upstreamErr, ok := fetch()
+			So(ok, ShouldBeTrue)
+			So(upstreamErr.Attempts, ShouldEqual, 1)
+		})
+	})
+
+	Convey("the default retry policy", t, func() {
+		bo := RetryPolicy{}.withDefaults().backOff(time.Second)
+		So(bo.InitialInterval, ShouldEqual, 50*time.Millisecond)
+		So(bo.MaxInterval, ShouldEqual, 30*time.Second)
+		So(bo.Multiplier, ShouldEqual, 1.5)
+		So(bo.RandomizationFactor, ShouldEqual, 0.5)
+		So(bo.MaxElapsedTime, ShouldEqual, time.Second)
+
+		bo = RetryPolicy{Jitter: -1}.withDefaults().backOff(time.Second)
+		So(bo.RandomizationFactor, ShouldEqual, 0)
+		So(bo.NextBackOff(), ShouldEqual, 50*time.Millisecond)
+	})
+}
+
+func TestRetryAfter(t *testing.T) {
+	Convey("Retry-After headers", t, func() {
+		now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		parse := func(v string) (time.Duration, bool) {
+			return retryAfter(http.Header{"Retry-After": {v}}, now)
+		}
+
+		Convey("are parsed as seconds or http date", func() {
+			d, ok := parse("120")
+			So(ok, ShouldBeTrue)
+			So(d, ShouldEqual, 2*time.Minute)
+
+			d, ok = parse(now.Add(time.Minute).Format(http.TimeFormat))
+			So(ok, ShouldBeTrue)
+			So(d, ShouldEqual, time.Minute)
+
+			d, ok = parse(now.Add(-time.Minute).Format(http.TimeFormat))
+			So(ok, ShouldBeTrue)
+			So(d, ShouldEqual, 0)
+
+			_, ok = parse("soon")
+			So(ok, ShouldBeFalse)
+		})
+
+		var (
+			hits       int32
+			retryAfter = "1"
+		)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&hits, 1) == 1 {
+				w.Header().Set("Retry-After", retryAfter)
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Write([]byte("snapshot"))
+		}))
+		defer ts.Close()
+
+		cfg := Config{Token: "123", Server: ts.URL, Timeout: 5 * time.Second}
+		get := func() *httptest.ResponseRecorder {
+			seo4ajaxClient, err := New(cfg)
+			So(err, ShouldBeNil)
+			req, err := http.NewRequest("GET", "http://"+appAdress+"/page?_escaped_fragment_=", nil)
+			So(err, ShouldBeNil)
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		Convey("delay the next attempt", func() {
+			start := time.Now()
+			recorder := get()
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, time.Second)
+			So(atomic.LoadInt32(&hits), ShouldEqual, 2)
+		})
+
+		Convey("beyond the timeout are relayed to the crawler", func() {
+			retryAfter = "3600"
+			start := time.Now()
+			recorder := get()
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+			So(recorder.Code, ShouldEqual, http.StatusServiceUnavailable)
+			So(recorder.Header().Get("Retry-After"), ShouldEqual, "3600")
+			So(atomic.LoadInt32(&hits), ShouldEqual, 1)
+		})
+
+		Convey("beyond the maximum interval are relayed without a timeout", func() {
+			cfg.Timeout = 0
+			retryAfter = "3600"
+			start := time.Now()
+			recorder := get()
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+			So(recorder.Code, ShouldEqual, http.StatusServiceUnavailable)
+			So(recorder.Header().Get("Retry-After"), ShouldEqual, "3600")
+			So(atomic.LoadInt32(&hits), ShouldEqual, 1)
+		})
+	})
+}
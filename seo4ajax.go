@@ -5,16 +5,17 @@ Before using, you need to set ServerIp to a valid IP address.
 package seo4ajax
 
 import (
+	"bufio"
+	"context"
 	"errors"
-	"fmt"
 	"io"
 	"net/http"
 	"net/url"
-	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/cenkalti/backoff"
 	"github.com/go-kit/kit/log"
 )
 
@@ -23,41 +24,134 @@ var (
 	ErrNoToken = errors.New("no token given")
 	// ErrCacheMiss happens if seo4ajax responded with a cache miss
 	ErrCacheMiss = errors.New("cache miss from seo4ajax")
+	// ErrPageNotFound happens if seo4ajax responded with page not found
+	ErrPageNotFound = errors.New("page not found by seo4ajax")
+	// ErrTooManyRequests happens if seo4ajax responded with too many requests
+	ErrTooManyRequests = errors.New("too many requests to seo4ajax")
 	// ErrUnknownStatus represents an unknown status code
 	ErrUnknownStatus = errors.New("Unknown Status Code")
-	errRedirect      = errors.New("SEO4AJAX: do not follow redirect")
 
-	regexInvalidUserAgent = regexp.MustCompile(`(?i:bing|msnbot|yandexbot|pinterest.*ios|mail\.ru)`)
-	regexValidUserAgent   = regexp.MustCompile(`(?i:bot|google|crawler|spider|archiver|pinterest|facebookexternalhit|flipboardproxy)`)
-	regexFilePath         = regexp.MustCompile(`.*(\.[^?]{2,4}$|\.[^?]{2,4}?.*)`)
-	regexIndexHTML        = regexp.MustCompile(`/index\.html?`)
+	// DefaultRelayStatus are the upstream status codes relayed to the client by default
+	DefaultRelayStatus = []int{
+		http.StatusOK,
+		http.StatusMovedPermanently,
+		http.StatusFound,
+		http.StatusSeeOther,
+		http.StatusNotModified,
+		http.StatusTemporaryRedirect,
+		http.StatusPermanentRedirect,
+		http.StatusNotFound,
+		http.StatusGone,
+	}
 )
 
 // Config is the Seo4Ajax Client config
 type Config struct {
 	Log       log.Logger
+	Metrics   Metrics
 	Next      http.Handler
 	Transport http.RoundTripper
+	Detector  Detector      // decides which requests are prerendered, defaults to DefaultDetector
+	Verifier  Verifier      // optionally verifies crawlers before prerendering, e.g. a DNSVerifier
 	Server    string        // seo4ajax api server, defaults to http://api.seo4ajax.com
 	Token     string        // seo4ajax token, must be set
 	IP        string        // server IP, defaults to 127.0.0.1
 	Timeout   time.Duration // retry timeout, defaults to 30s
 	// s4a supports client side caching and returns an empty 304 if the content hasn't changed.
 	// If UnconditionalFetch set to true the client side caching headers (If-Modified-Since and If-None-Match)
-	// are removed
+	// are removed. With a Cache, conditional requests are answered locally and the cached snapshots
+	// are revalidated with the validators of seo4ajax instead, unless UnconditionalFetch is set
 	UnconditionalFetch bool
 	// FetchErrorStatus is the http status code returned if the fetch from seo4ajax fails
 	FetchErrorStatus int
+	// ErrorStatus maps the last upstream status of a failed fetch to the http status code returned,
+	// e.g. 500 to 502. Unmapped statuses are returned as FetchErrorStatus
+	ErrorStatus map[int]int
+	// RelayStatus are the upstream status codes relayed to the client along with the body, or the
+	// Location for redirects. Defaults to DefaultRelayStatus, 200 is always relayed
+	RelayStatus []int
 	// FetchTimeout is the http timeout for a single fetch attempt
 	FetchTimeout time.Duration
-	// RetryUnavailable advises the retry loop to retry a fetch on 503 upstream results until success or Timeout
+	// BufferResponses reads the whole snapshot before responding, so failures while reading it are
+	// retried or reported instead of truncating the response, and sets Content-Length
+	BufferResponses bool
+	// MaxBufferSize is the size of the largest snapshot buffered, larger ones are streamed. Defaults to 10MB
+	MaxBufferSize int64
+	// MaxSnapshotSize rejects larger snapshots as upstream failures, they are read completely
+	// before responding then. No limit if zero
+	MaxSnapshotSize int64
+	// SnapshotContentTypes are the accepted media types of snapshots, e.g. text/html, others are
+	// rejected as upstream failures. Redirects aren't checked, all types are accepted if empty
+	SnapshotContentTypes []string
+	// RequestHeaders selects the request headers forwarded to seo4ajax
+	RequestHeaders RequestHeaderPolicy
+	// ResponseHeaders selects and rewrites the seo4ajax response headers relayed to the client
+	ResponseHeaders ResponseHeaderPolicy
+	// OnError is called with the error if GetPrerenderedPage fails to fetch a page, usually an *UpstreamError.
+	// It isn't called for cancelled requests
+	OnError func(r *http.Request, err error)
+	// RetryUnavailable advises the retry loop to retry a fetch on 503 (and 404 if not relayed) upstream results
+	// until success or Timeout
 	RetryUnavailable bool
+	// Retry configures the backoff and which failed fetches are retried
+	Retry RetryPolicy
+	// AllowUserAgents are additional user agents which are prerendered, even if
+	// the built-in lists exclude them (e.g. bingbot)
+	AllowUserAgents []UserAgentPattern
+	// DenyUserAgents are additional user agents which are never prerendered
+	DenyUserAgents []UserAgentPattern
+	// ReplaceUserAgents drops the built-in user agent lists, only AllowUserAgents and
+	// DenyUserAgents are used then
+	ReplaceUserAgents bool
+	// Cache is an optional snapshot cache in front of seo4ajax, e.g. a MemoryCache or FileCache
+	Cache Cache
+	// CacheVary are the request headers cached snapshots vary by, besides the path
+	CacheVary []string
+	// CacheTTL is the time to live of snapshots without Cache-Control or Expires headers, defaults to 10m
+	CacheTTL time.Duration
+	// CacheMaxEntrySize is the size of the largest snapshot cached, defaults to 10MB
+	CacheMaxEntrySize int64
+	// CacheStatusHeader is the response header reporting cache hits and misses, defaults to X-Cache
+	CacheStatusHeader string
+	// StaleRules configure serving expired snapshots from the Cache per path, the first matching rule applies
+	StaleRules []StaleRule
+	// MaxConcurrentFetches limits the number of upstream fetches in flight, no limit if zero
+	MaxConcurrentFetches int
+	// MaxQueuedFetches limits the number of fetches waiting for a free slot, further fetches are rejected.
+	// Defaults to MaxConcurrentFetches, fetches are rejected without waiting if negative
+	MaxQueuedFetches int
+	// QueueTimeout is the maximum time a fetch waits for a free slot, defaults to 1s
+	QueueTimeout time.Duration
+	// OverloadPolicy selects the response to requests whose fetch was rejected
+	OverloadPolicy OverloadPolicy
+	// OverloadRetryAfter is sent in the Retry-After header of rejected requests, defaults to 5s
+	OverloadRetryAfter time.Duration
+	// FailurePolicy selects the response to requests whose snapshot couldn't be fetched and which
+	// can't be served a stale snapshot, defaults to FailureError
+	FailurePolicy FailurePolicy
+	// FallbackHandler serves failed requests with FailurePolicy FailureFallback
+	FallbackHandler http.Handler
+	// Breaker configures the circuit breaker around seo4ajax, it's disabled by default
+	Breaker BreakerConfig
+	// Coalesce shares a single upstream fetch between concurrent requests for the same page,
+	// identified by the path, the CacheVary headers and the conditional headers
+	Coalesce bool
+	// InspectMeta enables parsing the prerender-status-code and prerender-header meta tags in the
+	// head of snapshots, which then replace the response status and headers (e.g. for soft 404s).
+	// HEAD requests are fetched with GET then, as the tags are only part of the snapshot
+	InspectMeta bool
+	// DebugHeader is the name of a response header which reports the prerender decision,
+	// e.g. X-Seo4ajax-Decision. It's not set if empty
+	DebugHeader string
 }
 
 // Client is the Seo4Ajax Client
 type Client struct {
 	log                log.Logger
+	metrics            Metrics
 	next               http.Handler
+	detector           Detector
+	verifier           Verifier
 	server             string
 	token              string
 	ip                 string
@@ -65,10 +159,39 @@ type Client struct {
 	http               *http.Client
 	unconditionalFetch bool
 	fetchErrorStatus   int
+	errorStatus        map[int]int
+	relayStatus        map[int]bool
 	retryUnavailable   bool
+	debugHeader        string
+	onError            func(r *http.Request, err error)
+	inspectMeta        bool
+	cache              Cache
+	cacheVary          []string
+	cacheTTL           time.Duration
+	cacheMaxEntrySize  int64
+	cacheStatusHeader  string
+	staleRules         []StaleRule
+	revalidatingMu     sync.Mutex
+	revalidating       map[string]bool
+	coalesce           bool
+	limiter            *limiter
+	breaker            *breaker
+	retry              RetryPolicy
+	bufferResponses    bool
+	maxBufferSize      int64
+	maxSnapshotSize    int64
+	snapshotTypes      map[string]bool
+	failurePolicy      FailurePolicy
+	fallback           http.Handler
+	overloadPolicy     OverloadPolicy
+	overloadRetryAfter time.Duration
+	flights            flights
+	requestHeaders     headerFilter
+	responseHeaders    responseHeaderPolicy
 }
 
 // New creates a new Seo4Ajax client. Returns an error if no token is provided
+// or the user agent patterns are invalid
 func New(cfg Config) (*Client, error) {
 	if cfg.Log == nil {
 		cfg.Log = log.NewNopLogger()
@@ -85,24 +208,95 @@ func New(cfg Config) (*Client, error) {
 	if cfg.Transport == nil {
 		cfg.Transport = http.DefaultTransport
 	}
+	if cfg.Detector == nil {
+		d, err := NewDefaultDetector(cfg.AllowUserAgents, cfg.DenyUserAgents, cfg.ReplaceUserAgents)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Detector = d
+	} else if len(cfg.AllowUserAgents) > 0 || len(cfg.DenyUserAgents) > 0 || cfg.ReplaceUserAgents {
+		return nil, errors.New("user agent lists can't be used with a custom detector")
+	}
 	if cfg.FetchErrorStatus == 0 {
 		cfg.FetchErrorStatus = http.StatusServiceUnavailable
 	}
+	if cfg.CacheTTL == 0 {
+		cfg.CacheTTL = 10 * time.Minute
+	}
+	if cfg.CacheMaxEntrySize == 0 {
+		cfg.CacheMaxEntrySize = 10 << 20
+	}
+	if cfg.MaxBufferSize == 0 {
+		cfg.MaxBufferSize = 10 << 20
+	}
+	if cfg.CacheStatusHeader == "" {
+		cfg.CacheStatusHeader = "X-Cache"
+	}
+	if cfg.MaxQueuedFetches == 0 {
+		cfg.MaxQueuedFetches = cfg.MaxConcurrentFetches
+	}
+	if cfg.QueueTimeout == 0 {
+		cfg.QueueTimeout = time.Second
+	}
+	if cfg.OverloadRetryAfter == 0 {
+		cfg.OverloadRetryAfter = 5 * time.Second
+	}
+	if cfg.RelayStatus == nil {
+		cfg.RelayStatus = DefaultRelayStatus
+	}
 
 	c := &Client{
 		log:                cfg.Log,
+		metrics:            cfg.Metrics.withDefaults(),
 		server:             cfg.Server,
 		token:              cfg.Token,
 		ip:                 cfg.IP,
 		timeout:            cfg.Timeout,
 		next:               cfg.Next,
+		detector:           cfg.Detector,
+		verifier:           cfg.Verifier,
 		unconditionalFetch: cfg.UnconditionalFetch,
 		fetchErrorStatus:   cfg.FetchErrorStatus,
+		errorStatus:        cfg.ErrorStatus,
+		relayStatus:        map[int]bool{http.StatusOK: true},
 		retryUnavailable:   cfg.RetryUnavailable,
+		retry:              cfg.Retry.withDefaults(),
+		bufferResponses:    cfg.BufferResponses,
+		maxBufferSize:      cfg.MaxBufferSize,
+		maxSnapshotSize:    cfg.MaxSnapshotSize,
+		snapshotTypes:      map[string]bool{},
+		debugHeader:        cfg.DebugHeader,
+		onError:            cfg.OnError,
+		inspectMeta:        cfg.InspectMeta,
+		cache:              cfg.Cache,
+		cacheTTL:           cfg.CacheTTL,
+		cacheMaxEntrySize:  cfg.CacheMaxEntrySize,
+		cacheStatusHeader:  cfg.CacheStatusHeader,
+		staleRules:         cfg.StaleRules,
+		revalidating:       map[string]bool{},
+		coalesce:           cfg.Coalesce,
+		limiter:            newLimiter(cfg.MaxConcurrentFetches, cfg.MaxQueuedFetches, cfg.QueueTimeout),
+		overloadPolicy:     cfg.OverloadPolicy,
+		overloadRetryAfter: cfg.OverloadRetryAfter,
+		failurePolicy:      cfg.FailurePolicy,
+		fallback:           cfg.FallbackHandler,
+		flights:            flights{m: map[string]*flight{}},
+		requestHeaders:     cfg.RequestHeaders.compile(),
+		responseHeaders:    cfg.ResponseHeaders.compile(),
+	}
+	c.breaker = newBreaker(cfg.Breaker, c.log, c.metrics.BreakerState)
+	for _, t := range cfg.SnapshotContentTypes {
+		c.snapshotTypes[strings.ToLower(t)] = true
+	}
+	for _, h := range cfg.CacheVary {
+		c.cacheVary = append(c.cacheVary, http.CanonicalHeaderKey(h))
+	}
+	for _, status := range cfg.RelayStatus {
+		c.relayStatus[status] = true
 	}
 	c.http = &http.Client{
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return errRedirect
+			return http.ErrUseLastResponse
 		},
 		Transport: cfg.Transport,
 	}
@@ -112,35 +306,30 @@ func New(cfg Config) (*Client, error) {
 	return c, nil
 }
 
-// IsPrerender returns true, when Seo4Ajax shall be used for the given http Request.
-// The logic is taken from https://github.com/seo4ajax/connect-s4a/blob/master/lib/connect-s4a.js
-func IsPrerender(r *http.Request) bool {
-	if r.Method != "GET" && r.Method != "HEAD" {
-		return false
-	}
-
-	if strings.Contains(r.URL.RawQuery, "_escaped_fragment_") {
-		return true
-	}
-
-	if regexInvalidUserAgent.MatchString(r.Header.Get("User-Agent")) {
-		return false
-	}
-
-	if !regexIndexHTML.MatchString(r.URL.Path) && regexFilePath.MatchString(r.URL.Path) {
-		return false
-	}
-
-	return regexValidUserAgent.MatchString(r.Header.Get("User-Agent"))
-}
-
 // ServeHTTP will serve the prerendered page if this is a prerender request.
 // If no upstream handler is set it will return an error. Otherwise it will
 // just invoke the upstream handler. This way it can be either used as an
 // HTTP middleware intercepting any prerender requests or an regular HTTP
 // handler (if next is nil) to serve only prerender request
 func (c *Client) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if IsPrerender(r) {
+	decision := c.detector.Detect(r)
+	if decision.Prerender && c.verifier != nil {
+		ok, err := c.verifier.Verify(r)
+		if err != nil {
+			c.log.Log("level", "warn", "msg", "Crawler verification failed", "err", err, "path", r.URL.Path)
+		}
+		if !ok {
+			c.log.Log("level", "info", "msg", "Unverified crawler", "user_agent", r.Header.Get("User-Agent"), "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+			decision = Decision{Rule: RuleUnverifiedCrawler}
+		}
+	}
+	if c.debugHeader != "" {
+		w.Header().Set(c.debugHeader, decision.String())
+	}
+
+	if decision.Prerender {
+		// only crawler requests are logged, regular traffic passes silently
+		c.log.Log("level", "debug", "msg", "Prerender decision", "rule", decision.Rule, "path", r.URL.Path)
 		c.GetPrerenderedPage(w, r)
 		return
 	}
@@ -154,79 +343,169 @@ func (c *Client) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-// GetPrerenderedPage returns the prerendered html from the seo4ajax api
+// GetPrerenderedPage returns the prerendered html from the seo4ajax api. HEAD requests are
+// answered with status and headers only, from the cache or a HEAD request to seo4ajax
 func (c *Client) GetPrerenderedPage(w http.ResponseWriter, r *http.Request) {
-	var outputStarted bool
-	opFunc := func() error {
-		req, err := http.NewRequest("GET", fmt.Sprintf("%s/%s%s", c.server, c.token, cleanPath(r.URL)), nil)
-		if err != nil {
-			return err
-		}
+	var (
+		key    = c.cacheKey(r)
+		cached *CacheEntry
+		stale  *CacheEntry
+	)
+	if c.cache != nil {
+		if entry, ok := c.cache.Get(key); ok {
+			cached = entry
+			now := time.Now()
+			if entry.Fresh(now) {
+				c.writePage(w, r, cachedPage(entry), CacheHit)
+				return
+			}
 
-		req.Header = r.Header
-		ips := []string{c.ip}
-		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-			ips = append(ips, xff)
+			rule := c.staleRule(r)
+			if now.Before(entry.Expires.Add(rule.WhileRevalidate)) {
+				c.revalidate(r, key, entry)
+				c.writePage(w, r, cachedPage(entry), CacheStale)
+				return
+			}
+			if now.Before(entry.Expires.Add(rule.IfError)) {
+				stale = entry
+			}
 		}
-		req.Header.Set("X-Forwarded-For", strings.Join(ips, ", "))
+	}
 
-		if c.unconditionalFetch {
-			req.Header.Del("If-Modified-Since")
-			req.Header.Del("If-None-Match")
+	var (
+		page   *Page
+		err    error
+		header = c.upstreamHeader(r.Header, cached)
+		// crawlers probing the page don't need a snapshot rendered, unless its meta tags may
+		// change the response
+		head = r.Method == http.MethodHead && !c.inspectMeta
+	)
+	switch {
+	case head:
+		page, err = c.FetchHead(r.Context(), r.URL, header)
+	case c.coalesce:
+		page, err = c.fetchCoalesced(r.Context(), key, r.URL, header)
+	default:
+		page, err = c.Fetch(r.Context(), r.URL, header)
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		// the client is gone, there is nobody to respond to
+		c.log.Log("level", "info", "msg", "Upstream request cancelled", "err", err, "path", r.URL.Path)
+		return
+	}
+	if err == ErrOverloaded {
+		c.overloaded(w, r, cached)
+		return
+	}
+	if err != nil {
+		c.log.Log("level", "warn", "msg", "Upstream request failed", "err", err, "path", r.URL.Path)
+		if c.onError != nil {
+			c.onError(r, err)
 		}
-
-		resp, err := c.http.Do(req)
-		if err != nil && !strings.HasSuffix(err.Error(), errRedirect.Error()) {
-			return err
+		if stale != nil {
+			c.log.Log("level", "info", "msg", "Serving stale snapshot", "path", r.URL.Path)
+			c.writePage(w, r, cachedPage(stale), CacheStale)
+			return
 		}
-		defer resp.Body.Close()
+		c.failed(w, r, err)
+		return
+	}
+	defer page.Body.Close()
 
-		if resp.StatusCode == http.StatusFound {
-			http.Redirect(w, r, resp.Header.Get("Location"), http.StatusFound)
-			return nil
+	if cached != nil && page.StatusCode == http.StatusNotModified {
+		c.writePage(w, r, cachedPage(c.refreshEntry(key, cached, page)), CacheRevalidated)
+		return
+	}
+
+	var cacheStatus string
+	if c.cache != nil {
+		if !head {
+			c.storePage(key, page)
 		}
+		cacheStatus = CacheMiss
+	}
+	c.writePage(w, r, page, cacheStatus)
+}
 
-		// conditionally terminate retry loop if the status code is 503 or 404
-		if !c.retryUnavailable {
-			if resp.StatusCode == http.StatusServiceUnavailable {
-				return backoff.Permanent(errors.New("page not yet rendered"))
-			}
-			if resp.StatusCode == http.StatusNotFound {
-				return backoff.Permanent(errors.New("page not found"))
+// writePage writes the page to the client. The cache status is reported if not empty
+func (c *Client) writePage(w http.ResponseWriter, r *http.Request, page *Page, cacheStatus string) {
+	var (
+		body   io.Reader = page.Body
+		status           = page.StatusCode
+		header           = page.Header
+	)
+	if c.inspectMeta && !isRedirect(page.StatusCode) && !encoded(page.Header) {
+		br := bufio.NewReaderSize(page.Body, maxInspectSize)
+		prefix, _ := br.Peek(maxInspectSize)
+		meta := inspectMeta(prefix)
+		if meta.status != 0 {
+			status = meta.status
+		}
+		if len(meta.header) > 0 {
+			// headers set by the snapshot are subject to the same policy as upstream headers
+			header = page.Header.Clone()
+			for k, v := range meta.header {
+				header[k] = v
 			}
 		}
+		body = br
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			// retry
-			return fmt.Errorf("expected 200 status code, got %d", resp.StatusCode)
+	c.responseHeaders.apply(r, w.Header(), header)
+	if cacheStatus != "" {
+		w.Header().Set(c.cacheStatusHeader, cacheStatus)
+	}
+	if location := w.Header().Get("Location"); isRedirect(page.StatusCode) || (isRedirect(status) && location != "") {
+		if location == "" {
+			location = page.Header.Get("Location")
 		}
-
-		for header, val := range resp.Header {
-			w.Header()[header] = val
+		// the length of the upstream body doesn't match the one written by http.Redirect
+		w.Header().Del("Content-Length")
+		http.Redirect(w, r, location, status)
+		return
+	}
+	if page.etag != "" {
+		w.Header().Set("ETag", page.etag)
+		if w.Header().Get("Last-Modified") == "" && !page.lastModified.IsZero() {
+			w.Header().Set("Last-Modified", page.lastModified.UTC().Format(http.TimeFormat))
 		}
-
-		outputStarted = true
-		// as soon as we start writing the body we must return nil, otherwise we'll
-		// mess up the HTTP response by calling response.WriteHeader multiple times
-		_, err = io.Copy(w, resp.Body)
-		return err
+		if status == http.StatusOK && notModified(r, page.etag, page.lastModified) {
+			w.Header().Del("Content-Length")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	if page.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(page.ContentLength, 10))
 	}
 
-	bo := backoff.NewExponentialBackOff()
-	bo.InitialInterval = 50 * time.Millisecond
-	bo.MaxInterval = 30 * time.Second
-	if c.timeout > 0 {
-		bo.MaxElapsedTime = c.timeout
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
 	}
-	err := backoff.Retry(opFunc, bo)
-	if err != nil {
-		c.log.Log("level", "warn", "msg", "Upstream request failed", "err", err, "path", r.URL.Path)
-		if !outputStarted {
-			http.Error(w, "Upstream error", c.fetchErrorStatus)
-			return
+	if _, err := io.Copy(w, body); err != nil {
+		c.log.Log("level", "warn", "msg", "Copying upstream response failed", "err", err, "path", r.URL.Path)
+	}
+}
+
+// errorStatusFor returns the status code sent to the client for a failed fetch
+func (c *Client) errorStatusFor(err error) int {
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		if status, ok := c.errorStatus[upstreamErr.StatusCode]; ok {
+			return status
 		}
 	}
-	return
+	return c.fetchErrorStatus
+}
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
 }
 
 func cleanPath(u *url.URL) string {
@@ -473,3 +473,59 @@ func (s *succeedOccasionally) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	}
 	http.Error(w, "rendered", http.StatusOK)
 }
+
+func TestStatusPassthrough(t *testing.T) {
+	Convey("upstream status codes", t, func() {
+		var status int
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if status >= 300 && status < 400 {
+				http.Redirect(w, r, "http://example.com/new", status)
+				return
+			}
+			w.WriteHeader(status)
+			w.Write([]byte("snapshot"))
+		}))
+		defer ts.Close()
+
+		seo4ajaxClient, err := New(Config{
+			Token:       "123",
+			Server:      ts.URL,
+			Timeout:     100 * time.Millisecond,
+			ErrorStatus: map[int]int{http.StatusInternalServerError: http.StatusBadGateway},
+		})
+		So(err, ShouldBeNil)
+
+		req, err := http.NewRequest("GET", "http://"+appAdress+"/?_escaped_fragment_=", nil)
+		So(err, ShouldBeNil)
+
+		Convey("404 and 410 are relayed with the snapshot", func() {
+			for _, status = range []int{http.StatusNotFound, http.StatusGone} {
+				recorder := httptest.NewRecorder()
+				seo4ajaxClient.ServeHTTP(recorder, req)
+				So(recorder.Code, ShouldEqual, status)
+				So(recorder.Body.String(), ShouldEqual, "snapshot")
+			}
+		})
+
+		Convey("redirects are relayed with their location", func() {
+			for _, status = range []int{301, 302, 303, 307, 308} {
+				recorder := httptest.NewRecorder()
+				seo4ajaxClient.ServeHTTP(recorder, req)
+				So(recorder.Code, ShouldEqual, status)
+				So(recorder.Header().Get("Location"), ShouldEqual, "http://example.com/new")
+			}
+		})
+
+		Convey("5xx are mapped", func() {
+			status = http.StatusInternalServerError
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusBadGateway)
+
+			status = http.StatusBadGateway
+			recorder = httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusServiceUnavailable)
+		})
+	})
+}
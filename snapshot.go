@@ -0,0 +1,88 @@
+package seo4ajax
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrSnapshotTooLarge is the cause of a SnapshotError if the snapshot exceeds MaxSnapshotSize
+	ErrSnapshotTooLarge = errors.New("snapshot too large")
+	// ErrSnapshotContentType is the cause of a SnapshotError if the snapshot has none of the
+	// SnapshotContentTypes
+	ErrSnapshotContentType = errors.New("snapshot content type not accepted")
+)
+
+// SnapshotError is wrapped by the UpstreamError returned by Fetch if seo4ajax delivered a
+// snapshot violating MaxSnapshotSize or SnapshotContentTypes. Such snapshots are never relayed
+type SnapshotError struct {
+	// ContentType is the Content-Type header of the snapshot
+	ContentType string
+	// Size is the announced or read size of the snapshot, -1 if unknown
+	Size int64
+	// Err is ErrSnapshotTooLarge or ErrSnapshotContentType
+	Err error
+}
+
+func (e *SnapshotError) Error() string {
+	switch e.Err {
+	case ErrSnapshotTooLarge:
+		return fmt.Sprintf("%v: %d bytes", e.Err, e.Size)
+	case ErrSnapshotContentType:
+		return fmt.Sprintf("%v: %q", e.Err, e.ContentType)
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the cause of the failure
+func (e *SnapshotError) Unwrap() error {
+	return e.Err
+}
+
+// checkSnapshot validates the response headers of a snapshot before its body is read
+func (c *Client) checkSnapshot(resp *http.Response) error {
+	contentType := resp.Header.Get("Content-Type")
+	if len(c.snapshotTypes) > 0 && !isRedirect(resp.StatusCode) && resp.StatusCode != http.StatusNotModified {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || !c.snapshotTypes[strings.ToLower(mediaType)] {
+			return &SnapshotError{ContentType: contentType, Size: resp.ContentLength, Err: ErrSnapshotContentType}
+		}
+	}
+	if c.maxSnapshotSize > 0 && resp.ContentLength > c.maxSnapshotSize {
+		return &SnapshotError{ContentType: contentType, Size: resp.ContentLength, Err: ErrSnapshotTooLarge}
+	}
+	return nil
+}
+
+// bufferBody reads the page body into memory. Bodies larger than MaxSnapshotSize are rejected,
+// without a size limit bodies larger than MaxBufferSize are streamed. The body is closed if
+// reading fails
+func (c *Client) bufferBody(page *Page) error {
+	limit := c.maxBufferSize
+	if c.maxSnapshotSize > 0 {
+		limit = c.maxSnapshotSize
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(page.Body, limit+1))
+	if err != nil {
+		page.Body.Close()
+		return err
+	}
+	if int64(len(body)) > limit {
+		if c.maxSnapshotSize > 0 {
+			page.Body.Close()
+			return &SnapshotError{ContentType: page.Header.Get("Content-Type"), Size: int64(len(body)), Err: ErrSnapshotTooLarge}
+		}
+		page.Body = readCloser{io.MultiReader(bytes.NewReader(body), page.Body), page.Body}
+		return nil
+	}
+	page.Body.Close()
+	page.Body = ioutil.NopCloser(bytes.NewReader(body))
+	page.ContentLength = int64(len(body))
+	return nil
+}
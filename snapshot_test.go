@@ -0,0 +1,97 @@
+package seo4ajax
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSnapshotValidation(t *testing.T) {
+	Convey("snapshots", t, func() {
+		var (
+			hits        int32
+			contentType atomic.Value
+		)
+		contentType.Store("text/html; charset=utf-8")
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			w.Header().Set("Content-Type", contentType.Load().(string))
+			if r.URL.Path == "/123/chunked" {
+				// flushing early omits the Content-Length header
+				w.(http.Flusher).Flush()
+			}
+			w.Write([]byte(strings.Repeat("x", 1000)))
+		}))
+		defer ts.Close()
+
+		fetches := &testCounter{}
+		cfg := Config{
+			Token:                "123",
+			Server:               ts.URL,
+			Timeout:              time.Second,
+			Metrics:              Metrics{Fetches: fetches},
+			MaxSnapshotSize:      1000,
+			SnapshotContentTypes: []string{"text/html"},
+		}
+		fetch := func(path string) (*Page, error) {
+			seo4ajaxClient, err := New(cfg)
+			So(err, ShouldBeNil)
+			return seo4ajaxClient.Fetch(context.Background(), &url.URL{Path: path}, nil)
+		}
+
+		Convey("within the limits are relayed", func() {
+			page, err := fetch("/page")
+			So(err, ShouldBeNil)
+			So(page.ContentLength, ShouldEqual, 1000)
+			page.Body.Close()
+			So(fetches.value("result=success"), ShouldEqual, 1)
+		})
+
+		Convey("with other content types are rejected", func() {
+			contentType.Store("application/json")
+			_, err := fetch("/page")
+			var snapshotErr *SnapshotError
+			So(errors.As(err, &snapshotErr), ShouldBeTrue)
+			So(snapshotErr.ContentType, ShouldEqual, "application/json")
+			So(errors.Is(err, ErrSnapshotContentType), ShouldBeTrue)
+			So(err.(*UpstreamError).StatusCode, ShouldEqual, http.StatusOK)
+			So(atomic.LoadInt32(&hits), ShouldEqual, 1)
+			So(fetches.value("result=invalid"), ShouldEqual, 1)
+		})
+
+		Convey("announced as too large are rejected", func() {
+			cfg.MaxSnapshotSize = 999
+			_, err := fetch("/page")
+			So(errors.Is(err, ErrSnapshotTooLarge), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, "1000 bytes")
+			So(fetches.value("result=invalid"), ShouldEqual, 1)
+		})
+
+		Convey("exceeding the size while read are rejected", func() {
+			cfg.MaxSnapshotSize = 999
+			_, err := fetch("/chunked")
+			So(errors.Is(err, ErrSnapshotTooLarge), ShouldBeTrue)
+			So(atomic.LoadInt32(&hits), ShouldEqual, 1)
+		})
+
+		Convey("failing validation aren't relayed to crawlers", func() {
+			contentType.Store("application/octet-stream")
+			seo4ajaxClient, err := New(cfg)
+			So(err, ShouldBeNil)
+			req, err := http.NewRequest("GET", "http://"+appAdress+"/page?_escaped_fragment_=", nil)
+			So(err, ShouldBeNil)
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusServiceUnavailable)
+			So(recorder.Body.String(), ShouldNotContainSubstring, "xxx")
+		})
+	})
+}
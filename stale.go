@@ -0,0 +1,66 @@
+package seo4ajax
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// CacheStale is reported in the CacheStatusHeader if an expired snapshot is served
+const CacheStale = "STALE"
+
+// StaleRule configures serving expired snapshots for matching paths
+type StaleRule struct {
+	// Path selects the request paths the rule applies to, all paths if nil
+	Path *regexp.Regexp
+	// WhileRevalidate is the time after expiry a snapshot is still served while it is
+	// refreshed in the background
+	WhileRevalidate time.Duration
+	// IfError is the time after expiry a snapshot is still served if fetching it fails
+	IfError time.Duration
+}
+
+// staleRule returns the first rule matching the request path
+func (c *Client) staleRule(r *http.Request) StaleRule {
+	for _, rule := range c.staleRules {
+		if rule.Path == nil || rule.Path.MatchString(r.URL.Path) {
+			return rule
+		}
+	}
+	return StaleRule{}
+}
+
+// revalidate refreshes the cached snapshot of the request in the background, conditionally on
+// the validators of the entry. Only one refresh per key runs at a time
+func (c *Client) revalidate(r *http.Request, key string, entry *CacheEntry) {
+	c.revalidatingMu.Lock()
+	if c.revalidating[key] {
+		c.revalidatingMu.Unlock()
+		return
+	}
+	c.revalidating[key] = true
+	c.revalidatingMu.Unlock()
+
+	u := *r.URL
+	header := c.upstreamHeader(r.Header, entry)
+	go func() {
+		defer func() {
+			c.revalidatingMu.Lock()
+			delete(c.revalidating, key)
+			c.revalidatingMu.Unlock()
+		}()
+
+		page, err := c.Fetch(context.Background(), &u, header)
+		if err != nil {
+			c.log.Log("level", "warn", "msg", "Revalidating cached snapshot failed", "err", err, "path", u.Path)
+			return
+		}
+		defer page.Body.Close()
+		if page.StatusCode == http.StatusNotModified {
+			c.refreshEntry(key, entry, page)
+			return
+		}
+		c.storePage(key, page)
+	}()
+}
@@ -0,0 +1,120 @@
+package seo4ajax
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStaleSnapshots(t *testing.T) {
+	Convey("expired snapshots", t, func() {
+		var (
+			status int32 = http.StatusOK
+			hits   int32
+		)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			if strings.HasSuffix(r.URL.Path, "/nostore") {
+				w.Header().Set("Cache-Control", "no-store")
+			}
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+			w.Write([]byte("new"))
+		}))
+		defer ts.Close()
+
+		cache := NewMemoryCache(10, 0)
+		seo4ajaxClient, err := New(Config{
+			Token:   "123",
+			Server:  ts.URL,
+			Timeout: 100 * time.Millisecond,
+			Cache:   cache,
+			StaleRules: []StaleRule{
+				{Path: regexp.MustCompile(`^/swr`), WhileRevalidate: time.Minute, IfError: time.Hour},
+				{IfError: time.Minute},
+			},
+		})
+		So(err, ShouldBeNil)
+
+		get := func(path string) *httptest.ResponseRecorder {
+			req, err := http.NewRequest("GET", "http://"+appAdress+path+"?_escaped_fragment_=", nil)
+			So(err, ShouldBeNil)
+			recorder := httptest.NewRecorder()
+			seo4ajaxClient.ServeHTTP(recorder, req)
+			return recorder
+		}
+		expired := func(path string, age time.Duration) {
+			req, err := http.NewRequest("GET", "http://"+appAdress+path+"?_escaped_fragment_=", nil)
+			So(err, ShouldBeNil)
+			cache.Set(seo4ajaxClient.cacheKey(req), &CacheEntry{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       []byte("old"),
+				StoredAt:   time.Now().Add(-age - time.Minute),
+				Expires:    time.Now().Add(-age),
+			})
+		}
+
+		Convey("stale-while-revalidate serves the old snapshot and refreshes it", func() {
+			expired("/swr", time.Second)
+			recorder := get("/swr")
+			So(recorder.Header().Get("X-Cache"), ShouldEqual, CacheStale)
+			So(recorder.Body.String(), ShouldEqual, "old")
+
+			deadline := time.Now().Add(5 * time.Second)
+			for time.Now().Before(deadline) {
+				if recorder = get("/swr"); recorder.Header().Get("X-Cache") == CacheHit {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(recorder.Header().Get("X-Cache"), ShouldEqual, CacheHit)
+			So(recorder.Body.String(), ShouldEqual, "new")
+			So(atomic.LoadInt32(&hits), ShouldEqual, 1)
+		})
+
+		Convey("stale-while-revalidate window is limited", func() {
+			expired("/swr", 2*time.Minute)
+			recorder := get("/swr")
+			So(recorder.Header().Get("X-Cache"), ShouldEqual, CacheMiss)
+			So(recorder.Body.String(), ShouldEqual, "new")
+		})
+
+		Convey("stale-if-error serves the old snapshot if fetching fails", func() {
+			atomic.StoreInt32(&status, http.StatusInternalServerError)
+			expired("/other", time.Second)
+			recorder := get("/other")
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(recorder.Header().Get("X-Cache"), ShouldEqual, CacheStale)
+			So(recorder.Body.String(), ShouldEqual, "old")
+
+			expired("/other", 2*time.Minute)
+			recorder = get("/other")
+			So(recorder.Code, ShouldEqual, http.StatusServiceUnavailable)
+		})
+
+		Convey("uncacheable fetches drop the stale snapshot", func() {
+			expired("/other/nostore", time.Second)
+			recorder := get("/other/nostore")
+			So(recorder.Header().Get("X-Cache"), ShouldEqual, CacheMiss)
+			So(recorder.Body.String(), ShouldEqual, "new")
+
+			atomic.StoreInt32(&status, http.StatusInternalServerError)
+			recorder = get("/other/nostore")
+			So(recorder.Code, ShouldEqual, http.StatusServiceUnavailable)
+			So(recorder.Body.String(), ShouldNotEqual, "old")
+		})
+
+		Convey("successful fetches replace the stale snapshot", func() {
+			expired("/other", time.Second)
+			recorder := get("/other")
+			So(recorder.Header().Get("X-Cache"), ShouldEqual, CacheMiss)
+			So(recorder.Body.String(), ShouldEqual, "new")
+		})
+	})
+}
@@ -0,0 +1,282 @@
+package seo4ajax
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Verifier checks whether a request claiming to come from a crawler really originates from it.
+// Requests not claiming a known crawler are passed as verified. If the verification could not
+// be completed an error is returned along with false.
+type Verifier interface {
+	Verify(r *http.Request) (bool, error)
+}
+
+// CrawlerFamily describes a crawler operator, the user agents it uses and the domains its
+// crawler hosts resolve to
+type CrawlerFamily struct {
+	Name           string
+	UserAgent      *regexp.Regexp
+	DomainSuffixes []string
+}
+
+// DefaultCrawlerFamilies are the crawlers verified if no families are configured
+var DefaultCrawlerFamilies = []CrawlerFamily{
+	{
+		Name:           "google",
+		UserAgent:      regexp.MustCompile(`(?i:googlebot|google-inspectiontool|googleother|adsbot-google|mediapartners-google|apis-google|feedfetcher-google|storebot-google)`),
+		DomainSuffixes: []string{".googlebot.com", ".google.com", ".googleusercontent.com"},
+	},
+	{
+		Name:           "bing",
+		UserAgent:      regexp.MustCompile(`(?i:bingbot|msnbot|adidxbot|bingpreview)`),
+		DomainSuffixes: []string{".search.msn.com"},
+	},
+	{
+		Name:           "apple",
+		UserAgent:      regexp.MustCompile(`(?i:applebot)`),
+		DomainSuffixes: []string{".applebot.apple.com"},
+	},
+	{
+		Name:           "yandex",
+		UserAgent:      regexp.MustCompile(`(?i:yandex)`),
+		DomainSuffixes: []string{".yandex.ru", ".yandex.net", ".yandex.com"},
+	},
+	{
+		Name:           "baidu",
+		UserAgent:      regexp.MustCompile(`(?i:baiduspider)`),
+		DomainSuffixes: []string{".baidu.com", ".baidu.jp"},
+	},
+}
+
+var errNoClientIP = errors.New("no client ip")
+
+func claimedFamily(families []CrawlerFamily, ua string) (CrawlerFamily, bool) {
+	for _, f := range families {
+		if f.UserAgent.MatchString(ua) {
+			return f, true
+		}
+	}
+	return CrawlerFamily{}, false
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", cidr, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// clientIP returns the IP of the client. Starting with the remote address, the X-Forwarded-For
+// header is followed from right to left as long as the hops are trusted proxies
+func clientIP(r *http.Request, trusted []*net.IPNet) net.IP {
+	ip := remoteIP(r)
+	if ip == nil || len(trusted) == 0 {
+		return ip
+	}
+
+	var hops []string
+	for _, xff := range r.Header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(xff, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	for i := len(hops) - 1; i >= 0 && isTrusted(ip, trusted); i-- {
+		hop := net.ParseIP(hops[i])
+		if hop == nil {
+			break
+		}
+		ip = hop
+	}
+	return ip
+}
+
+func isTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolver performs the DNS lookups of the DNSVerifier. It is satisfied by *net.Resolver
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DNSVerifierConfig is the DNSVerifier config
+type DNSVerifierConfig struct {
+	Resolver   Resolver        // defaults to net.DefaultResolver
+	Families   []CrawlerFamily // defaults to DefaultCrawlerFamilies
+	TTL        time.Duration   // how long verdicts are cached, defaults to 1h
+	MaxEntries int             // maximum number of cached verdicts, defaults to 10000
+	// TrustedProxies are the CIDRs of proxies in front of the server. X-Forwarded-For entries
+	// added by them are followed to find the client IP
+	TrustedProxies []string
+}
+
+// DNSVerifier verifies crawlers by a reverse DNS lookup of the client IP, checking the domain
+// of the crawler family and a forward lookup confirming the IP
+type DNSVerifier struct {
+	resolver   Resolver
+	families   []CrawlerFamily
+	trusted    []*net.IPNet
+	ttl        time.Duration
+	maxEntries int
+
+	mu       sync.Mutex
+	verdicts map[string]verdict
+}
+
+type verdict struct {
+	ok      bool
+	expires time.Time
+}
+
+// NewDNSVerifier creates a new DNSVerifier. Returns an error if a trusted proxy is not a valid CIDR
+func NewDNSVerifier(cfg DNSVerifierConfig) (*DNSVerifier, error) {
+	if cfg.Resolver == nil {
+		cfg.Resolver = net.DefaultResolver
+	}
+	if cfg.Families == nil {
+		cfg.Families = DefaultCrawlerFamilies
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = time.Hour
+	}
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = 10000
+	}
+	trusted, err := parseCIDRs(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return &DNSVerifier{
+		resolver:   cfg.Resolver,
+		families:   cfg.Families,
+		trusted:    trusted,
+		ttl:        cfg.TTL,
+		maxEntries: cfg.MaxEntries,
+		verdicts:   map[string]verdict{},
+	}, nil
+}
+
+// Verify implements Verifier
+func (v *DNSVerifier) Verify(r *http.Request) (bool, error) {
+	family, ok := claimedFamily(v.families, r.Header.Get("User-Agent"))
+	if !ok {
+		return true, nil
+	}
+	ip := clientIP(r, v.trusted)
+	if ip == nil {
+		return false, errNoClientIP
+	}
+
+	key := family.Name + "/" + ip.String()
+	if ok, found := v.cached(key); found {
+		return ok, nil
+	}
+
+	ok, err := v.lookup(r.Context(), ip, family)
+	if err != nil {
+		return false, err
+	}
+	v.store(key, ok)
+	return ok, nil
+}
+
+func (v *DNSVerifier) lookup(ctx context.Context, ip net.IP, family CrawlerFamily) (bool, error) {
+	names, err := v.resolver.LookupAddr(ctx, ip.String())
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if !hasDomainSuffix(name, family.DomainSuffixes) {
+			continue
+		}
+		addrs, err := v.resolver.LookupIPAddr(ctx, name)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (v *DNSVerifier) cached(key string) (ok, found bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	vd, found := v.verdicts[key]
+	if !found || time.Now().After(vd.expires) {
+		return false, false
+	}
+	return vd.ok, true
+}
+
+func (v *DNSVerifier) store(key string, ok bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := time.Now()
+	if len(v.verdicts) >= v.maxEntries {
+		for k, vd := range v.verdicts {
+			if now.After(vd.expires) {
+				delete(v.verdicts, k)
+			}
+		}
+		// still full, start over rather than tracking recency
+		if len(v.verdicts) >= v.maxEntries {
+			v.verdicts = map[string]verdict{}
+		}
+	}
+	v.verdicts[key] = verdict{ok: ok, expires: now.Add(v.ttl)}
+}
+
+func hasDomainSuffix(name string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
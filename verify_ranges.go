@@ -0,0 +1,230 @@
+package seo4ajax
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// RangeSource is a published IP range file of a crawler family, e.g.
+// https://developers.google.com/static/search/apis/ipranges/googlebot.json
+type RangeSource struct {
+	Family string // name of the CrawlerFamily
+	Path   string // path of the JSON file on disk
+}
+
+// RangeVerifierConfig is the RangeVerifier config
+type RangeVerifierConfig struct {
+	Log      log.Logger
+	Families []CrawlerFamily // defaults to DefaultCrawlerFamilies
+	Sources  []RangeSource   // range files loaded by NewRangeVerifier
+	// Refresh is the interval the Sources are reloaded in. No reload happens if zero
+	Refresh time.Duration
+	// TrustedProxies are the CIDRs of proxies in front of the server. X-Forwarded-For entries
+	// added by them are followed to find the client IP
+	TrustedProxies []string
+}
+
+// RangeVerifier verifies crawlers by checking the client IP against the published IP ranges of
+// the claimed crawler family. Families without loaded ranges are passed as verified.
+type RangeVerifier struct {
+	log      log.Logger
+	families []CrawlerFamily
+	sources  []RangeSource
+	trusted  []*net.IPNet
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu     sync.RWMutex
+	ranges map[string]ipRanges
+}
+
+// NewRangeVerifier creates a new RangeVerifier and loads the configured range files.
+// Returns an error if a file can't be loaded or a trusted proxy is not a valid CIDR
+func NewRangeVerifier(cfg RangeVerifierConfig) (*RangeVerifier, error) {
+	if cfg.Log == nil {
+		cfg.Log = log.NewNopLogger()
+	}
+	if cfg.Families == nil {
+		cfg.Families = DefaultCrawlerFamilies
+	}
+	trusted, err := parseCIDRs(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &RangeVerifier{
+		log:      cfg.Log,
+		families: cfg.Families,
+		sources:  cfg.Sources,
+		trusted:  trusted,
+		stop:     make(chan struct{}),
+		ranges:   map[string]ipRanges{},
+	}
+	if err := v.Reload(); err != nil {
+		return nil, err
+	}
+	if cfg.Refresh > 0 && len(cfg.Sources) > 0 {
+		go v.refresh(cfg.Refresh)
+	}
+	return v, nil
+}
+
+// Verify implements Verifier
+func (v *RangeVerifier) Verify(r *http.Request) (bool, error) {
+	family, ok := claimedFamily(v.families, r.Header.Get("User-Agent"))
+	if !ok {
+		return true, nil
+	}
+
+	v.mu.RLock()
+	ranges, ok := v.ranges[family.Name]
+	v.mu.RUnlock()
+	if !ok {
+		return true, nil
+	}
+
+	ip := clientIP(r, v.trusted)
+	if ip == nil {
+		return false, errNoClientIP
+	}
+	return ranges.contains(ip), nil
+}
+
+// Load replaces the ranges of the given crawler family with the ranges read from r
+func (v *RangeVerifier) Load(family string, r io.Reader) error {
+	ranges, err := parseRanges(r)
+	if err != nil {
+		return fmt.Errorf("loading %s ranges: %v", family, err)
+	}
+
+	v.mu.Lock()
+	v.ranges[family] = ranges
+	v.mu.Unlock()
+	return nil
+}
+
+// Reload loads all configured range files. Families keep their previous ranges if loading fails
+func (v *RangeVerifier) Reload() error {
+	for _, src := range v.sources {
+		f, err := os.Open(src.Path)
+		if err != nil {
+			return err
+		}
+		err = v.Load(src.Family, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops the periodic reload
+func (v *RangeVerifier) Close() {
+	v.stopOnce.Do(func() { close(v.stop) })
+}
+
+func (v *RangeVerifier) refresh(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := v.Reload(); err != nil {
+				v.log.Log("level", "warn", "msg", "Reloading crawler ranges failed", "err", err)
+			}
+		case <-v.stop:
+			return
+		}
+	}
+}
+
+// rangeFile is the format used by Google and Bing for their crawler IP ranges
+type rangeFile struct {
+	Prefixes []struct {
+		IPv4Prefix string `json:"ipv4Prefix"`
+		IPv6Prefix string `json:"ipv6Prefix"`
+	} `json:"prefixes"`
+}
+
+func parseRanges(r io.Reader) (ipRanges, error) {
+	var f rangeFile
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return nil, err
+	}
+
+	var nets []*net.IPNet
+	for _, p := range f.Prefixes {
+		for _, prefix := range []string{p.IPv4Prefix, p.IPv6Prefix} {
+			if prefix == "" {
+				continue
+			}
+			_, n, err := net.ParseCIDR(prefix)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, n)
+		}
+	}
+	return newIPRanges(nets), nil
+}
+
+// ipRanges is a sorted list of non-overlapping IP intervals, looked up by binary search
+type ipRanges []ipRange
+
+type ipRange struct {
+	first, last net.IP // both in 16 byte form
+}
+
+func newIPRanges(nets []*net.IPNet) ipRanges {
+	ranges := make(ipRanges, 0, len(nets))
+	for _, n := range nets {
+		first := n.IP.To16()
+		last := make(net.IP, net.IPv6len)
+		copy(last, first)
+		mask := n.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		for i := range last {
+			last[i] |= ^mask[i]
+		}
+		ranges = append(ranges, ipRange{first: first, last: last})
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].first, ranges[j].first) < 0
+	})
+
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && bytes.Compare(r.first, merged[n-1].last) <= 0 {
+			if bytes.Compare(r.last, merged[n-1].last) > 0 {
+				merged[n-1].last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+func (rs ipRanges) contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	i := sort.Search(len(rs), func(i int) bool {
+		return bytes.Compare(rs[i].first, ip) > 0
+	})
+	return i > 0 && bytes.Compare(ip, rs[i-1].last) <= 0
+}
@@ -0,0 +1,110 @@
+package seo4ajax
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const googlebotRanges = `{
+  "creationTime": "2024-01-01T00:00:00.000000",
+  "prefixes": [
+    {"ipv6Prefix": "2001:4860:4801:10::/64"},
+    {"ipv4Prefix": "66.249.64.0/27"},
+    {"ipv4Prefix": "66.249.64.16/28"},
+    {"ipv4Prefix": "66.249.66.0/27"}
+  ]
+}`
+
+func TestRangeVerifier(t *testing.T) {
+	googlebot := "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	newReq := func(ua, remoteAddr, xff string) *http.Request {
+		req, err := http.NewRequest("GET", "http://"+appAdress+"/path", nil)
+		So(err, ShouldBeNil)
+		req.Header.Set("User-Agent", ua)
+		if xff != "" {
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+		req.RemoteAddr = remoteAddr
+		return req
+	}
+
+	Convey("IP range verification", t, func() {
+		v, err := NewRangeVerifier(RangeVerifierConfig{TrustedProxies: []string{"10.0.0.0/8"}})
+		So(err, ShouldBeNil)
+		defer v.Close()
+		So(v.Load("google", strings.NewReader(googlebotRanges)), ShouldBeNil)
+
+		for _, tc := range []struct {
+			remoteAddr, xff string
+			want            bool
+		}{
+			{"66.249.64.1:1234", "", true},
+			{"66.249.64.31:1234", "", true},
+			{"66.249.64.32:1234", "", false},
+			{"66.249.66.17:1234", "", true},
+			{"[2001:4860:4801:10::1]:1234", "", true},
+			{"[2001:4860:4801:11::1]:1234", "", false},
+			{"10.0.0.1:1234", "66.249.64.1", true},
+			{"10.0.0.1:1234", "66.249.64.1, 10.0.0.2", true},
+			{"10.0.0.1:1234", "192.0.2.1", false},
+			{"10.0.0.1:1234", "66.249.64.1, 192.0.2.1", false},
+			{"192.0.2.1:1234", "66.249.64.1", false},
+		} {
+			ok, err := v.Verify(newReq(googlebot, tc.remoteAddr, tc.xff))
+			So(err, ShouldBeNil)
+			So(ok, ShouldEqual, tc.want)
+		}
+
+		Convey("families without ranges pass", func() {
+			ok, err := v.Verify(newReq("bingbot/2.0", "192.0.2.1:1234", ""))
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("requests not claiming a known crawler pass", func() {
+			ok, err := v.Verify(newReq("Twitterbot/1.0", "192.0.2.1:1234", ""))
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("invalid range files are rejected", func() {
+			So(v.Load("google", strings.NewReader(`{"prefixes":[{"ipv4Prefix":"nope"}]}`)), ShouldNotBeNil)
+			ok, err := v.Verify(newReq(googlebot, "66.249.64.1:1234", ""))
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+		})
+	})
+
+	Convey("range files are loaded from disk", t, func() {
+		dir, err := ioutil.TempDir("", "seo4ajax")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "googlebot.json")
+		So(ioutil.WriteFile(path, []byte(googlebotRanges), 0644), ShouldBeNil)
+
+		v, err := NewRangeVerifier(RangeVerifierConfig{Sources: []RangeSource{{Family: "google", Path: path}}})
+		So(err, ShouldBeNil)
+		defer v.Close()
+
+		ok, err := v.Verify(newReq(googlebot, "192.0.2.1:1234", ""))
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+
+		So(ioutil.WriteFile(path, []byte(`{"prefixes":[{"ipv4Prefix":"192.0.2.0/24"}]}`), 0644), ShouldBeNil)
+		So(v.Reload(), ShouldBeNil)
+		ok, err = v.Verify(newReq(googlebot, "192.0.2.1:1234", ""))
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		_, err = NewRangeVerifier(RangeVerifierConfig{Sources: []RangeSource{{Family: "google", Path: filepath.Join(dir, "missing.json")}}})
+		So(err, ShouldNotBeNil)
+		_, err = NewRangeVerifier(RangeVerifierConfig{TrustedProxies: []string{"10.0.0.1"}})
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,181 @@
+package seo4ajax
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type fakeResolver struct {
+	ptr     map[string][]string
+	a       map[string][]string
+	err     error
+	lookups int
+}
+
+func (f *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	f.lookups++
+	if f.err != nil {
+		return nil, f.err
+	}
+	names, ok := f.ptr[addr]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+	return names, nil
+}
+
+func (f *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := f.a[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func TestDNSVerifier(t *testing.T) {
+	googlebot := "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	newReq := func(ua, remoteAddr string) *http.Request {
+		req, err := http.NewRequest("GET", "http://"+appAdress+"/path", nil)
+		So(err, ShouldBeNil)
+		req.Header.Set("User-Agent", ua)
+		req.RemoteAddr = remoteAddr
+		return req
+	}
+
+	Convey("DNS verification", t, func() {
+		resolver := &fakeResolver{
+			ptr: map[string][]string{
+				"66.249.66.1": {"crawl-66-249-66-1.googlebot.com."},
+				"10.0.0.1":    {"crawl-66-249-66-1.googlebot.com."},
+				"10.0.0.2":    {"evil.example.com."},
+			},
+			a: map[string][]string{
+				"crawl-66-249-66-1.googlebot.com": {"66.249.66.1"},
+			},
+		}
+		v, err := NewDNSVerifier(DNSVerifierConfig{
+			Resolver:       resolver,
+			TTL:            time.Minute,
+			TrustedProxies: []string{"192.168.0.0/16"},
+		})
+		So(err, ShouldBeNil)
+
+		Convey("genuine crawler is verified", func() {
+			ok, err := v.Verify(newReq(googlebot, "66.249.66.1:1234"))
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("forward lookup must confirm the ip", func() {
+			ok, err := v.Verify(newReq(googlebot, "10.0.0.1:1234"))
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("domain must match the claimed family", func() {
+			ok, err := v.Verify(newReq(googlebot, "10.0.0.2:1234"))
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("missing reverse record is not verified", func() {
+			ok, err := v.Verify(newReq(googlebot, "10.0.0.3:1234"))
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("requests not claiming a known crawler pass", func() {
+			ok, err := v.Verify(newReq("Twitterbot/1.0", "10.0.0.3:1234"))
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(resolver.lookups, ShouldEqual, 0)
+		})
+
+		Convey("verdicts are cached", func() {
+			for i := 0; i < 3; i++ {
+				ok, err := v.Verify(newReq(googlebot, "66.249.66.1:1234"))
+				So(err, ShouldBeNil)
+				So(ok, ShouldBeTrue)
+			}
+			So(resolver.lookups, ShouldEqual, 1)
+		})
+
+		Convey("the client IP is taken from trusted proxies", func() {
+			req := newReq(googlebot, "192.168.1.1:1234")
+			req.Header.Set("X-Forwarded-For", "66.249.66.1")
+			ok, err := v.Verify(req)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+
+			req = newReq(googlebot, "10.0.0.3:1234")
+			req.Header.Set("X-Forwarded-For", "66.249.66.1")
+			ok, err = v.Verify(req)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("invalid trusted proxies are rejected", func() {
+			_, err := NewDNSVerifier(DNSVerifierConfig{TrustedProxies: []string{"nope"}})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("resolver errors are returned and not cached", func() {
+			resolver.err = errors.New("timeout")
+			ok, err := v.Verify(newReq(googlebot, "66.249.66.1:1234"))
+			So(err, ShouldNotBeNil)
+			So(ok, ShouldBeFalse)
+
+			resolver.err = nil
+			ok, err = v.Verify(newReq(googlebot, "66.249.66.1:1234"))
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+		})
+	})
+
+	Convey("impostors are routed to next", t, func() {
+		var hits int
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits++
+		}))
+		defer ts.Close()
+
+		resolver := &fakeResolver{
+			ptr: map[string][]string{"66.249.66.1": {"crawl-66-249-66-1.googlebot.com."}},
+			a:   map[string][]string{"crawl-66-249-66-1.googlebot.com": {"66.249.66.1"}},
+		}
+		verifier, err := NewDNSVerifier(DNSVerifierConfig{Resolver: resolver})
+		So(err, ShouldBeNil)
+		seo4ajaxClient, err := New(Config{
+			Token:       "123",
+			Server:      ts.URL,
+			Verifier:    verifier,
+			DebugHeader: "X-Seo4ajax-Decision",
+			Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			}),
+		})
+		So(err, ShouldBeNil)
+
+		recorder := httptest.NewRecorder()
+		seo4ajaxClient.ServeHTTP(recorder, newReq(googlebot, "10.0.0.2:1234"))
+		So(recorder.Code, ShouldEqual, http.StatusTeapot)
+		So(recorder.Header().Get("X-Seo4ajax-Decision"), ShouldEqual, "passthrough (unverified_crawler)")
+		So(hits, ShouldEqual, 0)
+
+		recorder = httptest.NewRecorder()
+		seo4ajaxClient.ServeHTTP(recorder, newReq(googlebot, "66.249.66.1:1234"))
+		So(recorder.Code, ShouldEqual, http.StatusOK)
+		So(hits, ShouldEqual, 1)
+	})
+}